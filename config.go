@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -12,8 +13,25 @@ const (
 )
 
 type emergencyOTPConfig struct {
+	tokenutil.TokenParams
+
 	YubiAuthClientId  string `json:"yubi_auth_client_id"`
 	YubiAuthClientKey string `json:"yubi_auth_client_key"`
+	// self-hosted YK-VAL servers, YubiCloud is used if empty
+	YubiAuthServers  []string `json:"yubi_auth_servers"`
+	YubiAuthCABundle string   `json:"yubi_auth_ca_bundle"`
+	YubiAuthProxy    string   `json:"yubi_auth_proxy"`
+	YubiAuthStrategy string   `json:"yubi_auth_strategy"`
+	// seconds
+	YubiAuthServerTimeout int `json:"yubi_auth_server_timeout"`
+	VerifyTimeout         int `json:"verify_timeout"`
+	// log in with OTPs whose counters the validation server did not report, without the replay check
+	AllowUnknownCounters bool `json:"allow_unknown_counters"`
+
+	// Vault API access used to revoke tokens, the system view can not do that
+	RevocationVaultAddr string `json:"revocation_vault_addr"`
+	RevocationToken     string `json:"revocation_token"`
+	RevocationCABundle  string `json:"revocation_ca_bundle"`
 
 	SMTPHost     string `json:"smtp_host"`
 	SMTPPort     int    `json:"smtp_port"`
@@ -21,6 +39,30 @@ type emergencyOTPConfig struct {
 	SMTPPassword string `json:"smtp_password"`
 	SMTPFrom     string `json:"smtp_from"`
 	SMTPTo       string `json:"smtp_to"`
+	// implicit, starttls or none, see newSMTPTransport for the default
+	SMTPTLSMode    string `json:"smtp_tls_mode"`
+	SMTPCABundle   string `json:"smtp_ca_bundle"`
+	SMTPServerName string `json:"smtp_server_name"`
+	// plain, login or cram-md5, picked from what the server offers if empty
+	SMTPAuth string `json:"smtp_auth"`
+	SMTPHelo string `json:"smtp_helo"`
+	// seconds
+	SMTPTimeout int `json:"smtp_timeout"`
+
+	// go templates of notification emails, the defaults are used if empty
+	EmailSubjectTemplate string `json:"email_subject_template"`
+	EmailTextTemplate    string `json:"email_text_template"`
+	EmailHTMLTemplate    string `json:"email_html_template"`
+	// armored OpenPGP private key notification emails are signed with
+	EmailSigningKey string `json:"email_signing_key"`
+
+	// DKIM signature of notification emails, emails are not signed if empty
+	DKIMDomain     string `json:"dkim_domain"`
+	DKIMSelector   string `json:"dkim_selector"`
+	DKIMPrivateKey string `json:"dkim_private_key"`
+
+	// seconds before a key becomes eligible to send reminders, defaultReminders if nil
+	Reminders []int64 `json:"reminders"`
 }
 
 func (b *backend) config(ctx context.Context, s logical.Storage) (*emergencyOTPConfig, error) {
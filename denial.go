@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// reasons a login was denied, for clients to act on
+const (
+	denyReasonNotEnrolled        = "not_enrolled"
+	denyReasonDisabled           = "disabled"
+	denyReasonWaiting            = "waiting"
+	denyReasonNotificationFailed = "notification_failed"
+)
+
+// loginDenial describes why a login with a valid OTP was denied.
+type loginDenial struct {
+	Reason string
+	// the human readable explanation shown by the CLI
+	Message string
+	// 0 if the key waits for an operator
+	NextEligibleTime  int64
+	NotificationSent  bool
+	NotificationError string
+	Notifications     []notifyResult
+	TimerChanged      bool
+	RequestID         string
+	// only set when the request was opened by this login
+	RequestSecret string
+}
+
+func (d *loginDenial) data(now time.Time) map[string]interface{} {
+	data := map[string]interface{}{
+		"reason":                  d.Reason,
+		"message":                 d.Message,
+		"next_eligible_time":      "",
+		"next_eligible_time_unix": d.NextEligibleTime,
+		"seconds_remaining":       int64(0),
+		"notification_sent":       d.NotificationSent,
+		"notification_error":      d.NotificationError,
+		"timer_changed":           d.TimerChanged,
+		"request_id":              d.RequestID,
+		"notifications":           d.Notifications,
+	}
+	if d.NextEligibleTime > 0 {
+		data["next_eligible_time"] = time.Unix(d.NextEligibleTime, 0).UTC().Format(time.RFC3339)
+		if remaining := d.NextEligibleTime - now.Unix(); remaining > 0 {
+			data["seconds_remaining"] = remaining
+		}
+	}
+	if d.Notifications == nil {
+		data["notifications"] = []notifyResult{}
+	}
+	if d.RequestSecret != "" {
+		data["request_secret"] = d.RequestSecret
+	}
+	return data
+}
+
+// response builds the error response of the denial with its data under "data", which Vault sends to
+// clients next to the error. The error wraps logical.ErrPermissionDenied so Vault answers 403 and counts
+// the login as failed.
+func (d *loginDenial) response() (*logical.Response, error) {
+	resp := logical.ErrorResponse(d.Message)
+	resp.Data["data"] = d.data(time.Now())
+	return resp, fmt.Errorf("%s: %w", d.Message, logical.ErrPermissionDenied)
+}
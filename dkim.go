@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// headers signed if the message has them, RFC 6376 section 5.4.1
+var dkimSignedHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+var dkimWSP = regexp.MustCompile(`[ \t]+`)
+
+// dkimSigner signs emails for a domain with relaxed/relaxed canonicalization.
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+}
+
+func newDKIMSigner(conf *emergencyOTPConfig) (*dkimSigner, error) {
+	if conf.DKIMDomain == "" || conf.DKIMSelector == "" || conf.DKIMPrivateKey == "" {
+		return nil, errors.New("dkim_domain, dkim_selector and dkim_private_key are required")
+	}
+	block, _ := pem.Decode([]byte(conf.DKIMPrivateKey))
+	if block == nil {
+		return nil, errors.New("dkim_private_key is not PEM encoded")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 1024 {
+			return nil, errors.New("RSA keys must have at least 1024 bits")
+		}
+		return &dkimSigner{domain: conf.DKIMDomain, selector: conf.DKIMSelector, key: key}, nil
+	case ed25519.PrivateKey:
+		return &dkimSigner{domain: conf.DKIMDomain, selector: conf.DKIMSelector, key: key}, nil
+	}
+	return nil, errors.New("dkim_private_key must be an RSA or Ed25519 key")
+}
+
+func (d *dkimSigner) algorithm() string {
+	if _, ok := d.key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// dkimCanonicalHeader is the relaxed canonical form of a header field, RFC 6376 section 3.4.2.
+func dkimCanonicalHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.TrimSpace(dkimWSP.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// dkimCanonicalBody is the relaxed canonical form of a body, RFC 6376 section 3.4.4.
+func dkimCanonicalBody(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(dkimWSP.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// splitEmail returns the header fields of a raw email, with folded lines joined, and its body.
+func splitEmail(raw []byte) (fields []string, body []byte, err error) {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, nil, errors.New("email has no body")
+	}
+	for _, line := range strings.Split(string(raw[:end]), "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields, raw[end+4:], nil
+}
+
+// sign prepends a DKIM-Signature header to a raw email.
+func (d *dkimSigner) sign(raw []byte, now time.Time) ([]byte, error) {
+	fields, body, err := splitEmail(raw)
+	if err != nil {
+		return nil, err
+	}
+	bodyHash := sha256.Sum256(dkimCanonicalBody(body))
+
+	var signed []string
+	h := sha256.New()
+	for _, name := range dkimSignedHeaders {
+		for _, field := range fields {
+			if fieldName, _, _ := strings.Cut(field, ":"); strings.EqualFold(strings.TrimSpace(fieldName), name) {
+				h.Write([]byte(dkimCanonicalHeader(field)))
+				signed = append(signed, strings.ToLower(name))
+				break
+			}
+		}
+	}
+	header := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		d.algorithm(), d.domain, d.selector, now.Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	// the signature header is signed with an empty b= and without its line break
+	h.Write([]byte(strings.TrimSuffix(dkimCanonicalHeader(header), "\r\n")))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	if key, ok := d.key.(ed25519.PrivateKey); ok {
+		// ed25519-sha256 signs the hash, RFC 8463
+		sig = ed25519.Sign(key, digest)
+	} else if sig, err = d.key.Sign(rand.Reader, digest, crypto.SHA256); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	buf.WriteString(base64.StdEncoding.EncodeToString(sig))
+	buf.WriteString("\r\n")
+	buf.Write(raw)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestDKIMCanonicalization(t *testing.T) {
+	// examples of RFC 6376 section 3.4.5
+	if got := dkimCanonicalHeader("A: X") + dkimCanonicalHeader("B : Y\t\r\n\tZ  "); got != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("unexpected headers %q", got)
+	}
+	if got := string(dkimCanonicalBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))); got != " C\r\nD E\r\n" {
+		t.Errorf("unexpected body %q", got)
+	}
+	if got := dkimCanonicalBody([]byte("\r\n\r\n")); len(got) != 0 {
+		t.Errorf("unexpected empty body %q", got)
+	}
+}
+
+// testVerifyDKIM checks the signature of a signed email like a receiver would.
+func testVerifyDKIM(t *testing.T, signed []byte, public crypto.PublicKey) map[string]string {
+	fields, body, err := splitEmail(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigField := fields[0]
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(strings.TrimPrefix(sigField, "DKIM-Signature: "), "; ") {
+		k, v, _ := strings.Cut(tag, "=")
+		tags[k] = v
+	}
+	bodyHash := sha256.Sum256(dkimCanonicalBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Errorf("body hash mismatch")
+	}
+
+	h := sha256.New()
+	for _, name := range strings.Split(tags["h"], ":") {
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(strings.ToLower(field), name+":") {
+				h.Write([]byte(dkimCanonicalHeader(field)))
+				break
+			}
+		}
+	}
+	unsigned := strings.TrimSuffix(sigField, tags["b"])
+	h.Write([]byte(strings.TrimSuffix(dkimCanonicalHeader(unsigned), "\r\n")))
+	sig, _ := base64.StdEncoding.DecodeString(tags["b"])
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, h.Sum(nil), sig); err != nil {
+			t.Errorf("bad signature: %v", err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(public, h.Sum(nil), sig) {
+			t.Errorf("bad signature")
+		}
+	}
+	return tags
+}
+
+func TestDKIMSignature(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	edPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}))
+
+	b, s := testBackend(t)
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "config", map[string]interface{}{
+		"dkim_domain": "example.com",
+	}); err != nil || !resp.IsError() {
+		t.Errorf("expected incomplete DKIM config to be rejected, got %v %v", resp, err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "config", map[string]interface{}{
+		"dkim_domain":      "example.com",
+		"dkim_selector":    "vault",
+		"dkim_private_key": rsaPEM,
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to write DKIM config: %v %v", resp, err)
+	}
+	resp, err := testRequest(b, s, logical.ReadOperation, "config", nil)
+	if err != nil || resp.Data["dkim_private_key"] != "********" || resp.Data["dkim_selector"] != "vault" {
+		t.Errorf("unexpected config %v %v", resp, err)
+	}
+
+	e := &emailNotifier{
+		conf: &emergencyOTPConfig{SMTPFrom: "vault@example.com", DKIMDomain: "example.com", DKIMSelector: "vault", DKIMPrivateKey: rsaPEM},
+		s:    s,
+		to:   []string{"oncall@example.com"},
+	}
+	emails, err := e.compose(context.Background(), &notification{Event: eventLogin, KeyName: "somebody", RemoteAddr: "192.0.2.1"}, time.Now())
+	if err != nil || len(emails) != 1 {
+		t.Fatalf("unexpected emails %v %v", emails, err)
+	}
+	tags := testVerifyDKIM(t, emails[0].raw, &rsaKey.PublicKey)
+	if tags["a"] != "rsa-sha256" || tags["d"] != "example.com" || tags["s"] != "vault" ||
+		tags["h"] != "from:to:subject:date:message-id:mime-version:content-type" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+
+	ed, err := newDKIMSigner(&emergencyOTPConfig{DKIMDomain: "example.com", DKIMSelector: "ed", DKIMPrivateKey: edPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ed.sign([]byte("From: vault@example.com\r\nSubject: a\r\n  folded\r\n\r\nbody  \r\n\r\n"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := testVerifyDKIM(t, signed, edPublic); tags["a"] != "ed25519-sha256" || tags["h"] != "from:subject" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+}
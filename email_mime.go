@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/hashicorp/go-uuid"
+)
+
+// subject of encrypted emails, the real subject is inside the encrypted part
+const encryptedEmailSubject = "Encrypted notification from Vault"
+
+// mimeEntity is a MIME part with its headers, kept as bytes so it can be signed as it is sent.
+type mimeEntity struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// bytes writes the entity like multipart.Writer does: headers sorted by key, CRLF line endings.
+func (m *mimeEntity) bytes() []byte {
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(m.header))
+	for k := range m.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range m.header[k] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(m.body)
+	return buf.Bytes()
+}
+
+func quotedPrintableEntity(contentType string, content string) (*mimeEntity, error) {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := io.WriteString(w, content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &mimeEntity{header: header, body: buf.Bytes()}, nil
+}
+
+func multipartEntity(subtype string, params map[string]string, parts ...*mimeEntity) (*mimeEntity, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		pw, err := w.CreatePart(p.header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if params == nil {
+		params = make(map[string]string)
+	}
+	params["boundary"] = w.Boundary()
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, params))
+	return &mimeEntity{header: header, body: buf.Bytes()}, nil
+}
+
+// emailContentEntity puts the text and HTML bodies side by side. A protected subject is
+// carried inside the entity for encrypted emails, as clients supporting protected headers expect it.
+func emailContentEntity(text string, html string, protectedSubject string) (*mimeEntity, error) {
+	textPart, err := quotedPrintableEntity("text/plain; charset=UTF-8", text)
+	if err != nil {
+		return nil, err
+	}
+	htmlPart, err := quotedPrintableEntity("text/html; charset=UTF-8", html)
+	if err != nil {
+		return nil, err
+	}
+	var params map[string]string
+	if protectedSubject != "" {
+		params = map[string]string{"protected-headers": "v1"}
+	}
+	content, err := multipartEntity("alternative", params, textPart, htmlPart)
+	if err != nil {
+		return nil, err
+	}
+	if protectedSubject != "" {
+		content.header.Set("Subject", mime.QEncoding.Encode("utf-8", protectedSubject))
+	}
+	return content, nil
+}
+
+// pgpSignedEntity wraps content in a PGP/MIME signed entity, RFC 3156 section 5.
+func pgpSignedEntity(content *mimeEntity, signer *openpgp.Entity) (*mimeEntity, error) {
+	signature, err := pgpDetachSign(signer, content.bytes())
+	if err != nil {
+		return nil, err
+	}
+	sigHeader := make(textproto.MIMEHeader)
+	sigHeader.Set("Content-Type", `application/pgp-signature; name="signature.asc"`)
+	sigHeader.Set("Content-Description", "OpenPGP digital signature")
+	return multipartEntity("signed", map[string]string{
+		"micalg":   pgpMicAlg,
+		"protocol": "application/pgp-signature",
+	}, content, &mimeEntity{header: sigHeader, body: signature})
+}
+
+// pgpEncryptedEntity encrypts content to a recipient in a PGP/MIME encrypted entity, RFC 3156 section 4.
+// It is also signed if signer is not nil.
+func pgpEncryptedEntity(content *mimeEntity, to *openpgp.Entity, signer *openpgp.Entity) (*mimeEntity, error) {
+	encrypted, err := pgpEncrypt(to, signer, content.bytes())
+	if err != nil {
+		return nil, err
+	}
+	versionHeader := make(textproto.MIMEHeader)
+	versionHeader.Set("Content-Type", "application/pgp-encrypted")
+	versionHeader.Set("Content-Description", "PGP/MIME version identification")
+	dataHeader := make(textproto.MIMEHeader)
+	dataHeader.Set("Content-Type", `application/octet-stream; name="encrypted.asc"`)
+	dataHeader.Set("Content-Disposition", `inline; filename="encrypted.asc"`)
+	dataHeader.Set("Content-Description", "OpenPGP encrypted message")
+	return multipartEntity("encrypted", map[string]string{"protocol": "application/pgp-encrypted"},
+		&mimeEntity{header: versionHeader, body: []byte("Version: 1\r\n")},
+		&mimeEntity{header: dataHeader, body: encrypted})
+}
+
+// outgoingEmail is a message ready to be sent, rcpt are the envelope recipients.
+type outgoingEmail struct {
+	rcpt []string
+	raw  []byte
+}
+
+func (m *outgoingEmail) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(m.raw)
+	return int64(n), err
+}
+
+func newOutgoingEmail(from string, to []string, subject string, body *mimeEntity, now time.Time) (*outgoingEmail, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	domain := "emerg-yubiotp"
+	if i := strings.LastIndex(recipientAddress(from), "@"); i >= 0 {
+		domain = recipientAddress(from)[i+1:]
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", id, domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.Write(body.bytes())
+
+	rcpt := make([]string, len(to))
+	for i, addr := range to {
+		rcpt[i] = recipientAddress(addr)
+	}
+	return &outgoingEmail{rcpt: rcpt, raw: buf.Bytes()}, nil
+}
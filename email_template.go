@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const defaultEmailSubjectTemplate = `{{.Title}}`
+
+const defaultEmailTextTemplate = `
+{{- if .Owner -}}
+This is about your Emergency OTP Key '{{.Key}}'. If you did not use it, your YubiKey may be in the wrong hands: tell your security team right away.
+
+{{end -}}
+{{- if .FurtherAttempts -}}
+{{.FurtherAttempts}} further attempts were held back since the previous notification, this is the latest.
+
+{{end -}}
+{{- if gt .EscalationTier 1 -}}
+Nobody acknowledged the previous notifications, this was escalated to tier {{.EscalationTier}}.
+
+{{end -}}
+{{- if eq .Event "security" -}}
+A {{.Security.Type}} event was recorded for YubiKey '{{.PublicID}}' from {{.RemoteAddr}} at {{.Time}}.
+{{.Security.Description}}
+Details: {{.Security.Detail}}
+{{- if .Key}}
+Use "{{.DisableCommand}}" to disable this key.
+{{- end}}
+{{- else if eq .Event "login" -}}
+Emergency OTP Key '{{.Key}}' was used to log in to Vault from {{.RemoteAddr}} at {{.Time}}.
+Use "{{.DisableCommand}}" to disable this key and revoke its tokens.
+{{- else if eq .Event "reminder" -}}
+Emergency OTP Key '{{.Key}}' becomes eligible on Vault {{.Access}}.
+{{- if .RemoteAddr}}
+The activation was started from {{.RemoteAddr}}.
+{{- end}}
+If it is not expected, use "{{.DisableCommand}}" to stop it before then.
+{{- else if eq .Event "eligible" -}}
+The waiting period of Emergency OTP Key '{{.Key}}' is over, it can now be used to log in to Vault.
+{{- if .RemoteAddr}}
+The activation was started from {{.RemoteAddr}}.
+{{- end}}
+Use "{{.DisableCommand}}" to disable this key.
+{{- else if eq .Event "request" -}}
+The activation request {{.RequestID}} of Emergency OTP Key '{{.Key}}' started from {{.RemoteAddr}} is {{.RequestState}}.
+Use "{{.DisableCommand}}" to disable this key.
+{{- else -}}
+Emergency OTP Key '{{.Key}}' was used on Vault from {{.RemoteAddr}} at {{.Time}}.
+Access: {{.Access}}
+Activation request: {{.RequestID}}
+Use "{{.DisableCommand}}" to disable this key.
+{{- end}}
+{{- if .AckCommand}}
+Use "{{.AckCommand}}" to acknowledge and stop the escalation.
+{{- end}}
+`
+
+const defaultEmailHTMLTemplate = `<html>
+<body>
+<h3>{{.Title}}</h3>
+{{- if .Owner}}
+<p><strong>This is about your Emergency OTP Key '{{.Key}}'. If you did not use it, your YubiKey may be in the wrong hands: tell your security team right away.</strong></p>
+{{- end}}
+{{- if .FurtherAttempts}}
+<p>{{.FurtherAttempts}} further attempts were held back since the previous notification, this is the latest.</p>
+{{- end}}
+{{- if gt .EscalationTier 1}}
+<p>Nobody acknowledged the previous notifications, this was escalated to tier {{.EscalationTier}}.</p>
+{{- end}}
+{{- if eq .Event "security"}}
+<p>A <strong>{{.Security.Type}}</strong> event was recorded for YubiKey <code>{{.PublicID}}</code> from {{.RemoteAddr}} at {{.Time}}.</p>
+<p>{{.Security.Description}}</p>
+<p>Details: {{.Security.Detail}}</p>
+{{- else}}
+<table>
+<tr><td>Key</td><td>{{.Key}}{{if .Alias}} ({{.Alias}}){{end}}</td></tr>
+<tr><td>Public ID</td><td><code>{{.PublicID}}</code></td></tr>
+<tr><td>From</td><td>{{.RemoteAddr}}</td></tr>
+<tr><td>Time</td><td>{{.Time}}</td></tr>
+{{- if or (eq .Event "activation") (eq .Event "reminder") (eq .Event "eligible")}}
+<tr><td>Access</td><td>{{.Access}}</td></tr>
+{{- end}}
+{{- if .RequestID}}
+<tr><td>Activation request</td><td><code>{{.RequestID}}</code>{{if .RequestState}} ({{.RequestState}}){{end}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Key}}
+<p>Disable this key with <code>{{.DisableCommand}}</code></p>
+{{- end}}
+{{- if .AckCommand}}
+<p>Acknowledge and stop the escalation with <code>{{.AckCommand}}</code></p>
+{{- end}}
+</body>
+</html>
+`
+
+// emailTemplateData is what email templates are executed with, the fields are documented in the README.
+type emailTemplateData struct {
+	Event      string
+	Title      string
+	MountPoint string
+
+	Key      string
+	Alias    string
+	EntityID string
+	PublicID string
+
+	RemoteAddr string
+	Time       time.Time
+	// zero if the key waits for an operator
+	NextEligibleTime time.Time
+	Access           string
+	// minutes
+	Delay     int64
+	DelayMail int64
+
+	RequestID    string
+	RequestState string
+
+	DisableCommand string
+	Security       *emailSecurityData
+	// the email goes to the owner of the key
+	Owner bool
+	// notifications held back since the previous one
+	FurtherAttempts int
+	// empty unless an escalation policy sent the email
+	AckCommand     string
+	EscalationTier int
+}
+
+type emailSecurityData struct {
+	Type        string
+	Severity    string
+	Detail      string
+	Description string
+}
+
+func newEmailTemplateData(n *notification, now time.Time) *emailTemplateData {
+	d := &emailTemplateData{
+		Event:           n.Event,
+		Title:           n.title(),
+		MountPoint:      n.MountPoint,
+		Key:             n.KeyName,
+		Alias:           n.KeyAlias,
+		EntityID:        n.EntityID,
+		PublicID:        n.PublicID,
+		RemoteAddr:      n.RemoteAddr,
+		Time:            time.Unix(n.Time, 0).UTC(),
+		Access:          n.countdown(now),
+		Delay:           n.Delay,
+		DelayMail:       n.DelayMail,
+		RequestID:       n.RequestID,
+		RequestState:    n.RequestState,
+		Owner:           n.Owner,
+		FurtherAttempts: n.FurtherAttempts,
+		EscalationTier:  n.EscalationTier,
+	}
+	if n.NextEligibleTime > 0 {
+		d.NextEligibleTime = time.Unix(n.NextEligibleTime, 0).UTC()
+	}
+	if n.KeyName != "" {
+		d.DisableCommand = n.disableCommand()
+	}
+	if n.EscalationID != "" {
+		d.AckCommand = n.ackCommand()
+	}
+	if n.Security != nil {
+		d.Security = &emailSecurityData{
+			Type:        n.Security.Type,
+			Severity:    n.Security.Severity,
+			Detail:      n.Security.Detail,
+			Description: securityEventDescriptions[n.Security.Type],
+		}
+	}
+	return d
+}
+
+// emailTemplates are the parsed templates of a mount config.
+type emailTemplates struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+func parseEmailTemplates(conf *emergencyOTPConfig) (*emailTemplates, error) {
+	subject, text, html := conf.EmailSubjectTemplate, conf.EmailTextTemplate, conf.EmailHTMLTemplate
+	if subject == "" {
+		subject = defaultEmailSubjectTemplate
+	}
+	if text == "" {
+		text = defaultEmailTextTemplate
+	}
+	if html == "" {
+		html = defaultEmailHTMLTemplate
+	}
+
+	t := &emailTemplates{}
+	var err error
+	if t.subject, err = template.New("subject").Parse(subject); err != nil {
+		return nil, err
+	}
+	if t.text, err = template.New("text").Parse(text); err != nil {
+		return nil, err
+	}
+	if t.html, err = htmltemplate.New("html").Parse(html); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// render fills the templates for a notification, the subject is put on a single line.
+func (t *emailTemplates) render(n *notification, now time.Time) (subject string, text string, html string, err error) {
+	data := newEmailTemplateData(n, now)
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, data); err != nil {
+		return "", "", "", err
+	}
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+	buf.Reset()
+	if err := t.text.Execute(&buf, data); err != nil {
+		return "", "", "", err
+	}
+	text = buf.String()
+	buf.Reset()
+	if err := t.html.Execute(&buf, data); err != nil {
+		return "", "", "", err
+	}
+	html = buf.String()
+	return subject, text, html, nil
+}
+
+// validateEmailTemplates parses the templates of a config and renders every kind of notification with them,
+// so mistakes like unknown fields show up on write and not when a key is used.
+func validateEmailTemplates(conf *emergencyOTPConfig) error {
+	t, err := parseEmailTemplates(conf)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	sample := notification{
+		Time:             now.Unix(),
+		MountPoint:       "auth/emerg-yubiotp/",
+		RemoteAddr:       "192.0.2.1",
+		KeyName:          "somebody",
+		KeyAlias:         "somebody-key-1",
+		PublicID:         "vvcccccccccc",
+		EntityID:         "entity",
+		Delay:            60,
+		DelayMail:        30,
+		NextEligibleTime: now.Add(30 * time.Minute).Unix(),
+		RequestID:        "request",
+		RequestState:     requestStatePending,
+	}
+	for _, event := range notifyEvents {
+		for _, owner := range []bool{false, true} {
+			n := sample
+			n.Event = event
+			n.Owner = owner
+			if event == eventSecurity {
+				n.Security = &securityEvent{Type: securityEventReplayedOTP, Severity: severityCritical, Time: n.Time,
+					PublicID: n.PublicID, RemoteAddr: n.RemoteAddr, Detail: "detail"}
+			}
+			if _, _, _, err := t.render(&n, now); err != nil {
+				return fmt.Errorf("%s notification: %w", event, err)
+			}
+		}
+	}
+	// security events of keys that are not enrolled have no key
+	probe := sample
+	probe.Event, probe.KeyName, probe.KeyAlias, probe.EntityID, probe.RequestID, probe.RequestState = eventSecurity, "", "", "", "", ""
+	probe.Security = &securityEvent{Type: securityEventUnknownKey, Severity: severityInfo, Time: probe.Time,
+		PublicID: probe.PublicID, RemoteAddr: probe.RemoteAddr, Detail: "detail"}
+	if _, _, _, err := t.render(&probe, now); err != nil {
+		return fmt.Errorf("security notification of an unknown key: %w", err)
+	}
+	return nil
+}
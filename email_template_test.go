@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestDefaultEmailTemplates(t *testing.T) {
+	templates, err := parseEmailTemplates(&emergencyOTPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1683491419, 0)
+	n := &notification{
+		Event:            eventActivation,
+		Time:             now.Unix(),
+		MountPoint:       "auth/breakglass/",
+		RemoteAddr:       "192.0.2.1",
+		KeyName:          "somebody",
+		KeyAlias:         "<script>",
+		PublicID:         testPublicID,
+		NextEligibleTime: now.Add(time.Hour).Unix(),
+		RequestID:        "request-1",
+	}
+	subject, text, html, err := templates.render(n, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Emergency OTP Key 'somebody' was used on Vault" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	for _, want := range []string{
+		"from 192.0.2.1 at 2023-05-07 20:30:19 +0000 UTC",
+		"Access: in 1h0m0s (at 2023-05-07T21:30:19Z)",
+		"Activation request: request-1",
+		`Use "vault write auth/breakglass/key/somebody next_eligible_time=-1"`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text body misses %q:\n%s", want, text)
+		}
+	}
+	if !strings.Contains(html, "&lt;script&gt;") || !strings.Contains(html, "auth/breakglass/key/somebody") {
+		t.Errorf("unexpected html body:\n%s", html)
+	}
+}
+
+func TestEmailTemplateConfig(t *testing.T) {
+	b, s := testBackend(t)
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "config", map[string]interface{}{
+		"email_subject_template": "[vault] {{.Event}}\n{{.Key}}",
+		"email_text_template":    "{{.Key}} from {{.RemoteAddr}} on {{.MountPoint}}",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to write templates: %v %v", resp, err)
+	}
+	conf, err := b.config(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := parseEmailTemplates(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, text, _, err := templates.render(&notification{
+		Event: eventLogin, KeyName: "somebody", RemoteAddr: "192.0.2.1", MountPoint: "auth/breakglass/",
+	}, time.Now())
+	if err != nil || subject != "[vault] login somebody" || text != "somebody from 192.0.2.1 on auth/breakglass/" {
+		t.Errorf("unexpected email %q %q %v", subject, text, err)
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"email_subject_template": "{{.Key"},
+		{"email_text_template": "{{.Nope}}"},
+		{"email_html_template": "{{.Security.Type}}"},
+	} {
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "config", data); err != nil || !resp.IsError() {
+			t.Errorf("expected %v to be rejected, got %v %v", data, resp, err)
+		}
+	}
+}
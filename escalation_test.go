@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestQuietHours(t *testing.T) {
+	q, err := parseQuietHours("22:00-07:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for at, quiet := range map[string]bool{
+		"2024-01-10T21:30:00Z": true,
+		"2024-01-10T05:59:00Z": true,
+		"2024-01-10T06:00:00Z": false,
+		"2024-01-10T12:00:00Z": false,
+	} {
+		tm, _ := time.Parse(time.RFC3339, at)
+		if q.contains(tm) != quiet {
+			t.Errorf("expected quiet at %s to be %v", at, quiet)
+		}
+	}
+	for _, spec := range []string{"22:00", "25:00-07:00", "07:00-07:00"} {
+		if _, err := parseQuietHours(spec, ""); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+	if _, err := parseQuietHours("", "Mars/Olympus"); err == nil {
+		t.Error("expected unknown time zone to be invalid")
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	b, s := testBackend(t)
+	ctx := context.Background()
+	now := time.Now()
+	// tier 2 sleeps when it would be escalated to
+	at := now.Add(16 * time.Minute).UTC()
+	quiet := at.Add(-time.Hour).Format("15:04") + "-" + at.Add(time.Hour).Format("15:04")
+	for name, data := range map[string]map[string]interface{}{
+		"first":  {"type": "memory", "box": t.Name() + "-first", "events": "request"},
+		"second": {"type": "memory", "box": t.Name() + "-second", "events": "request", "quiet_hours": quiet},
+		"third":  {"type": "memory", "box": t.Name() + "-third", "events": "request"},
+		// gets logins anyway
+		"all": {"type": "memory", "box": t.Name() + "-all", "events": "login"},
+	} {
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/"+name, data); err != nil || resp.IsError() {
+			t.Fatalf("failed to create channel %s: %v %v", name, resp, err)
+		}
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "escalation-policy/oncall", map[string]interface{}{
+		"tier_1": "first", "tier_3": "third",
+	}); err != nil || !resp.IsError() {
+		t.Errorf("expected a gap between tiers to be rejected: %v %v", resp, err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "escalation-policy/oncall", map[string]interface{}{
+		"events": "login", "tier_1": "first,all", "tier_2": "second", "tier_3": "third", "tier_3_after": "30m",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create policy: %v %v", resp, err)
+	}
+
+	login := func() {
+		t.Helper()
+		if _, err := b.notify(ctx, s, &notification{Event: eventLogin, KeyName: "somebody", RequestID: "r1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	login()
+	login()
+	sent := testNotifier.take(t.Name() + "-first")
+	if len(sent) != 1 || sent[0].EscalationTier != 1 || sent[0].EscalationID == "" {
+		t.Fatalf("expected tier 1 to be notified once, got %+v", sent)
+	}
+	id := sent[0].EscalationID
+	if sent := testNotifier.take(t.Name() + "-all"); len(sent) != 1 || sent[0].EscalationID != "" {
+		t.Errorf("expected the subscribed channel to be notified once, got %+v", sent)
+	}
+
+	if err := b.escalateDue(ctx, s, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if sent := testNotifier.take(t.Name() + "-second"); len(sent) != 0 {
+		t.Errorf("tier 2 notified before its wait: %+v", sent)
+	}
+	// tier 2 is in its quiet hours and passed over, tier 3 still waits for its time
+	if err := b.escalateDue(ctx, s, now.Add(16*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if sent := append(testNotifier.take(t.Name()+"-second"), testNotifier.take(t.Name()+"-third")...); len(sent) != 0 {
+		t.Errorf("notified when tier 2 is quiet: %+v", sent)
+	}
+	if err := b.escalateDue(ctx, s, now.Add(47*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	sent = testNotifier.take(t.Name() + "-third")
+	if len(sent) != 1 || sent[0].EscalationTier != 3 || sent[0].title() != "Emergency OTP Key 'somebody' was used to log in to Vault (escalated to tier 3)" {
+		t.Errorf("unexpected tier 3 notifications %+v", sent)
+	}
+
+	resp, err := testRequest(b, s, logical.UpdateOperation, "escalation/"+id+"/ack", nil)
+	if err != nil || resp.IsError() || resp.Data["state"] != escalationAcknowledged {
+		t.Fatalf("failed to acknowledge: %v %v", resp, err)
+	}
+
+	// after the acknowledgement a new activation escalates again, the channels keep their throttles
+	if _, err := b.notify(ctx, s, &notification{Event: eventLogin, KeyName: "somebody", RequestID: "r2"}); err != nil {
+		t.Fatal(err)
+	}
+	if sent := testNotifier.take(t.Name() + "-first"); len(sent) != 0 {
+		t.Fatalf("tier 1 notified within its throttle: %+v", sent)
+	}
+	if err := b.flushThrottles(ctx, s, time.Now().Add(defaultNotifyThrottle)); err != nil {
+		t.Fatal(err)
+	}
+	testNotifier.take(t.Name() + "-all")
+	sent = testNotifier.take(t.Name() + "-first")
+	if len(sent) != 1 || sent[0].EscalationID == id || sent[0].EscalationID == "" || sent[0].FurtherAttempts != 1 {
+		t.Fatalf("expected a follow-up of the new escalation, got %+v", sent)
+	}
+	if _, err := testRequest(b, s, logical.UpdateOperation, "escalation/"+sent[0].EscalationID+"/ack", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.escalateDue(ctx, s, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if sent := append(testNotifier.take(t.Name()+"-second"), testNotifier.take(t.Name()+"-third")...); len(sent) != 0 {
+		t.Errorf("acknowledged escalation went on: %+v", sent)
+	}
+}
+
+func TestEscalationRetryQuietHours(t *testing.T) {
+	b, s := testBackend(t)
+	ctx := context.Background()
+	now := time.Now()
+	// the pager sleeps an hour from now
+	at := now.Add(time.Hour).UTC()
+	pager := map[string]interface{}{
+		"type": "memory", "box": t.Name() + "-pager", "events": "security", "fail": true,
+		"quiet_hours": at.Add(-30*time.Minute).Format("15:04") + "-" + at.Add(30*time.Minute).Format("15:04"),
+	}
+	for name, data := range map[string]map[string]interface{}{
+		"pager": pager,
+		"later": {"type": "memory", "box": t.Name() + "-later", "events": "security"},
+	} {
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/"+name, data); err != nil || resp.IsError() {
+			t.Fatalf("failed to create channel %s: %v %v", name, resp, err)
+		}
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "escalation-policy/oncall", map[string]interface{}{
+		"events": "login", "tier_1": "pager", "tier_2": "later", "tier_2_after": "3h",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create policy: %v %v", resp, err)
+	}
+
+	results, err := b.notify(ctx, s, &notification{Event: eventLogin, KeyName: "somebody", RequestID: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	for _, r := range results {
+		if r.Channel == "pager" {
+			id = r.ID
+		}
+	}
+	if id == "" {
+		t.Fatalf("tier 1 was not notified: %+v", results)
+	}
+	pager["fail"] = false
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/pager", pager); err != nil || resp.IsError() {
+		t.Fatalf("failed to update channel: %v %v", resp, err)
+	}
+
+	// the retry waits for the quiet hours to end
+	if err := b.retryDeliveries(ctx, s, at); err != nil {
+		t.Fatal(err)
+	}
+	if d := testDelivery(t, b, s, id); d["attempts"] != 1 || d["state"] != deliveryPending || d["next_attempt_time"].(int64) <= at.Unix() {
+		t.Errorf("retried in the quiet hours: %v", d)
+	}
+	if sent := testNotifier.take(t.Name() + "-pager"); len(sent) != 0 {
+		t.Errorf("notified in the quiet hours: %+v", sent)
+	}
+	later := at.Add(2 * time.Hour)
+	if err := b.retryDeliveries(ctx, s, later); err != nil {
+		t.Fatal(err)
+	}
+	if d := testDelivery(t, b, s, id); d["attempts"] != 2 || d["state"] != deliveryDelivered {
+		t.Errorf("not retried after the quiet hours: %v", d)
+	}
+	if sent := testNotifier.take(t.Name() + "-pager"); len(sent) != 1 || sent[0].EscalationTier != 1 {
+		t.Errorf("unexpected notifications %+v", sent)
+	}
+}
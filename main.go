@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/eternal-flame-AD/yubigo"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/sdk/plugin"
 )
@@ -48,17 +52,25 @@ func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, er
 type backend struct {
 	*framework.Backend
 
-	yubiAuth *yubigo.YubiAuth
+	verifierLock sync.RWMutex
+	verifier     otpVerifier
+
+	// serialize the read-check-write of key states, see lockKey
+	keyLocks []*locksutil.LockEntry
+
+	newRevoker func(conf *emergencyOTPConfig) (tokenRevoker, error)
 }
 
 func Backend(c *logical.BackendConfig) *backend {
 	var b backend
+	b.newRevoker = newAPITokenRevoker
+	b.keyLocks = locksutil.CreateLocks()
 
 	b.Backend = &framework.Backend{
 		BackendType: logical.TypeCredential,
 		AuthRenew:   b.pathAuthRenew,
 		PathsSpecial: &logical.Paths{
-			Unauthenticated: []string{"login"},
+			Unauthenticated: []string{"login", "request/+/status"},
 		},
 		Paths: []*framework.Path{
 			{
@@ -78,15 +90,107 @@ func Backend(c *logical.BackendConfig) *backend {
 			},
 			b.pathConfig(),
 		},
-		InitializeFunc: func(ctx context.Context, req *logical.InitializationRequest) (err error) {
-			if conf, errC := b.config(ctx, req.Storage); err != nil {
-				return errC
-			} else if conf.YubiAuthClientId != "" {
-				b.yubiAuth, err = yubigo.NewYubiAuth(conf.YubiAuthClientId, conf.YubiAuthClientKey)
+		InitializeFunc: func(ctx context.Context, req *logical.InitializationRequest) error {
+			conf, err := b.config(ctx, req.Storage)
+			if err != nil {
+				return err
 			}
-			return
+			return b.resetVerifier(conf)
 		},
 	}
+	b.Backend.PeriodicFunc = b.periodic
+	// the session paths must come first, key/ matches anything below it
+	b.Backend.Paths = append(b.Backend.Paths, b.pathSessions()...)
 	b.Backend.Paths = append(b.Backend.Paths, b.pathKeys()...)
+	b.Backend.Paths = append(b.Backend.Paths, b.pathRequests()...)
+	b.Backend.Paths = append(b.Backend.Paths, b.pathNotify()...)
+	b.Backend.Paths = append(b.Backend.Paths, b.pathRecipients()...)
+	b.Backend.Paths = append(b.Backend.Paths, b.pathNotifications()...)
+	b.Backend.Paths = append(b.Backend.Paths, b.pathEscalations()...)
 	return &b
 }
+
+// periodic runs every housekeeping step even if an earlier one failed, the errors are combined.
+func (b *backend) periodic(ctx context.Context, req *logical.Request) error {
+	var errs *multierror.Error
+	if err := b.pruneSessions(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("failed to prune sessions: %w", err))
+	}
+	if err := b.advanceRequests(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("failed to advance requests: %w", err))
+	}
+	if err := b.remindKeys(ctx, req.Storage, time.Now()); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("failed to send reminders: %w", err))
+	}
+	if err := b.flushThrottles(ctx, req.Storage, time.Now()); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("failed to flush throttles: %w", err))
+	}
+	if err := b.escalateDue(ctx, req.Storage, time.Now()); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("failed to escalate: %w", err))
+	}
+	if err := b.retryDeliveries(ctx, req.Storage, time.Now()); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("failed to retry notifications: %w", err))
+	}
+	return errs.ErrorOrNil()
+}
+
+// listRecursive lists the entries below prefix relative to it, descending into entries with slashes, e.g. key names.
+func listRecursive(ctx context.Context, s logical.Storage, prefix string) ([]string, error) {
+	var paths []string
+	prefixes := []string{""}
+	for len(prefixes) > 0 {
+		dir := prefixes[0]
+		prefixes = prefixes[1:]
+		entries, err := s.List(ctx, prefix+dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry, "/") {
+				prefixes = append(prefixes, dir+entry)
+			} else {
+				paths = append(paths, dir+entry)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// resetVerifier rebuilds the remote OTP verifier from the config.
+func (b *backend) resetVerifier(conf *emergencyOTPConfig) error {
+	var verifier otpVerifier
+	if len(conf.YubiAuthServers) > 0 {
+		v, err := newYKValVerifier(ykvalOptions{
+			ClientID:      conf.YubiAuthClientId,
+			ClientKey:     conf.YubiAuthClientKey,
+			Servers:       conf.YubiAuthServers,
+			CABundle:      conf.YubiAuthCABundle,
+			Proxy:         conf.YubiAuthProxy,
+			Strategy:      conf.YubiAuthStrategy,
+			Timeout:       time.Duration(conf.VerifyTimeout) * time.Second,
+			ServerTimeout: time.Duration(conf.YubiAuthServerTimeout) * time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		verifier = v
+	} else if conf.YubiAuthClientId != "" {
+		v, err := newYubiCloudVerifier(conf.YubiAuthClientId, conf.YubiAuthClientKey, time.Duration(conf.VerifyTimeout)*time.Second)
+		if err != nil {
+			return err
+		}
+		verifier = v
+	}
+
+	b.verifierLock.Lock()
+	defer b.verifierLock.Unlock()
+	b.verifier = verifier
+	return nil
+}
+
+// remoteVerifier returns the verifier for keys without a secret on file, nil if none is configured.
+func (b *backend) remoteVerifier() otpVerifier {
+	b.verifierLock.RLock()
+	defer b.verifierLock.RUnlock()
+	return b.verifier
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// chat channels post to Slack or Mattermost incoming webhooks, both understand attachments
+var chatChannelType = &channelType{
+	Fields: httpChannelFields(map[string]*framework.FieldSchema{
+		"url": {
+			Type:        framework.TypeString,
+			Description: "Incoming webhook URL, it is the credential of the webhook and not shown on read",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Sensitive: true,
+			},
+		},
+		"channel": {
+			Type:        framework.TypeString,
+			Description: "Chat channel overriding the one of the webhook",
+		},
+		"username": {
+			Type:        framework.TypeString,
+			Description: "Name the messages are posted as",
+		},
+	}),
+	New: func(conf *emergencyOTPConfig, s logical.Storage, settings *framework.FieldData) (notifier, error) {
+		u, err := parseNotifyURL(settings.Get("url").(string))
+		if err != nil {
+			return nil, err
+		}
+		client, err := newNotifyHTTPClient(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &chatNotifier{
+			url:      u.String(),
+			channel:  settings.Get("channel").(string),
+			username: settings.Get("username").(string),
+			client:   client,
+		}, nil
+	},
+}
+
+type chatNotifier struct {
+	url      string
+	channel  string
+	username string
+	client   *http.Client
+}
+
+type chatField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type chatAttachment struct {
+	Fallback string      `json:"fallback"`
+	Color    string      `json:"color"`
+	Title    string      `json:"title"`
+	Text     string      `json:"text"`
+	Fields   []chatField `json:"fields"`
+	Footer   string      `json:"footer,omitempty"`
+	TS       int64       `json:"ts"`
+}
+
+type chatMessage struct {
+	Text        string           `json:"text"`
+	Channel     string           `json:"channel,omitempty"`
+	Username    string           `json:"username,omitempty"`
+	Attachments []chatAttachment `json:"attachments"`
+}
+
+func newChatMessage(n *notification, now time.Time) *chatMessage {
+	att := chatAttachment{
+		Fallback: n.title(),
+		Color:    "warning",
+		Title:    n.title(),
+		TS:       n.Time,
+	}
+	if n.KeyName != "" {
+		att.Fields = append(att.Fields,
+			chatField{Title: "Key", Value: n.KeyName, Short: true},
+			chatField{Title: "Alias", Value: n.KeyAlias, Short: true})
+	}
+	att.Fields = append(att.Fields,
+		chatField{Title: "Public ID", Value: n.PublicID, Short: true},
+		chatField{Title: "Source IP", Value: n.RemoteAddr, Short: true})
+
+	text := ":rotating_light: An emergency key was used on Vault"
+	switch n.Event {
+	case eventActivation:
+		att.Fields = append(att.Fields, chatField{Title: "Access", Value: n.countdown(now), Short: false})
+	case eventLogin:
+		text = ":unlock: A token was issued to an emergency key on Vault"
+		att.Color = "danger"
+	case eventReminder:
+		text = ":hourglass: An emergency key becomes eligible on Vault soon"
+		att.Fields = append(att.Fields, chatField{Title: "Access", Value: n.countdown(now), Short: false})
+	case eventEligible:
+		text = ":alarm_clock: An emergency key can now be used on Vault"
+		att.Color = "danger"
+		att.Fields = append(att.Fields, chatField{Title: "Access", Value: n.countdown(now), Short: false})
+	case eventRequest:
+		text = ":information_source: An emergency activation on Vault changed"
+		att.Color = "good"
+		att.Fields = append(att.Fields, chatField{Title: "State", Value: n.RequestState, Short: true})
+	case eventSecurity:
+		text = ":warning: Security alert on Vault"
+		att.Color = "danger"
+		att.Text = fmt.Sprintf("*%s*: %s\n%s", n.Security.Type, securityEventDescriptions[n.Security.Type], n.Security.Detail)
+	}
+	if n.RequestID != "" {
+		att.Footer = "Activation request " + n.RequestID
+	}
+	if n.KeyName != "" {
+		att.Fields = append(att.Fields, chatField{
+			Title: "Disable the key",
+			Value: "`" + n.disableCommand() + "`",
+		})
+	}
+	if n.EscalationID != "" {
+		att.Fields = append(att.Fields, chatField{
+			Title: "Acknowledge",
+			Value: "`" + n.ackCommand() + "`",
+		})
+	}
+	return &chatMessage{
+		Text:        text,
+		Attachments: []chatAttachment{att},
+	}
+}
+
+func (c *chatNotifier) Notify(ctx context.Context, n *notification) error {
+	msg := newChatMessage(n, time.Now())
+	msg.Channel = c.channel
+	msg.Username = c.username
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := doNotifyRequest(c.client, req); err != nil {
+		return fmt.Errorf("chat webhook failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestChatMessage(t *testing.T) {
+	now := time.Now()
+	msg := newChatMessage(&notification{
+		Event:            eventActivation,
+		Time:             now.Unix(),
+		MountPoint:       "auth/breakglass/",
+		RemoteAddr:       "192.0.2.1",
+		KeyName:          "somebody",
+		KeyAlias:         "somebody-key-1",
+		PublicID:         testPublicID,
+		NextEligibleTime: now.Add(90 * time.Minute).Unix(),
+	}, now)
+
+	fields := make(map[string]string)
+	for _, f := range msg.Attachments[0].Fields {
+		fields[f.Title] = f.Value
+	}
+	if fields["Disable the key"] != "`vault write auth/breakglass/key/somebody next_eligible_time=-1`" {
+		t.Errorf("unexpected disable command %q", fields["Disable the key"])
+	}
+	if fields["Alias"] != "somebody-key-1" || fields["Source IP"] != "192.0.2.1" || !strings.HasPrefix(fields["Access"], "in 1h30m0s") {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+func TestChatNotification(t *testing.T) {
+	messages := make(chan chatMessage, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg chatMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		messages <- msg
+	}))
+	defer srv.Close()
+
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/ops", map[string]interface{}{
+		"type":     "mattermost",
+		"url":      srv.URL,
+		"channel":  "ops",
+		"username": "vault",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	resp, err := testRequest(b, s, logical.ReadOperation, "notify/ops", nil)
+	if err != nil || resp.Data["url"] != "********" || resp.Data["channel"] != "ops" {
+		t.Errorf("webhook URL not masked: %v %v", resp, err)
+	}
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+		"delay":     60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err = testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if denial := testDenial(t, resp, err); denial["notification_sent"] != true {
+		t.Fatalf("chat message not delivered: %v", denial)
+	}
+	msg := <-messages
+	if msg.Channel != "ops" || msg.Username != "vault" || len(msg.Attachments) != 1 ||
+		!strings.Contains(msg.Attachments[0].Title, "somebody") {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
@@ -2,36 +2,126 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
-	"gopkg.in/gomail.v2"
 )
 
-func (b *backend) sendNotificationEmail(ctx context.Context, req *logical.Request, key *keyState) (sent bool, err error) {
-	var config *emergencyOTPConfig
-	config, err = b.config(ctx, req.Storage)
-	if config == nil {
-		return false, nil
-	} else if err != nil {
-		return false, err
+// email channels send through the SMTP server of the mount config
+var emailChannelType = &channelType{
+	Fields: map[string]*framework.FieldSchema{
+		"to": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Email recipients",
+		},
+	},
+	New: func(conf *emergencyOTPConfig, s logical.Storage, settings *framework.FieldData) (notifier, error) {
+		transport, err := newSMTPTransport(conf)
+		if err != nil {
+			return nil, err
+		}
+		to := settings.Get("to").([]string)
+		if len(to) == 0 {
+			return nil, errors.New("no recipients")
+		}
+		return &emailNotifier{conf: conf, s: s, transport: transport, to: to}, nil
+	},
+}
+
+type emailNotifier struct {
+	conf      *emergencyOTPConfig
+	s         logical.Storage
+	transport *smtpTransport
+	to        []string
+}
+
+func (e *emailNotifier) Notify(ctx context.Context, n *notification) error {
+	emails, err := e.compose(ctx, n, time.Now())
+	if err != nil {
+		return err
 	}
-	if config.SMTPHost == "" {
-		return false, nil
+	return e.transport.send(recipientAddress(e.conf.SMTPFrom), emails)
+}
+
+// compose renders the emails of a notification: one encrypted email for each recipient
+// with an OpenPGP key, and one for all other recipients. They are DKIM signed if configured.
+func (e *emailNotifier) compose(ctx context.Context, n *notification, now time.Time) ([]*outgoingEmail, error) {
+	templates, err := parseEmailTemplates(e.conf)
+	if err != nil {
+		return nil, err
+	}
+	subject, text, html, err := templates.render(n, now)
+	if err != nil {
+		return nil, err
+	}
+	var signer *openpgp.Entity
+	if e.conf.EmailSigningKey != "" {
+		if signer, err = readPGPSigningKey(e.conf.EmailSigningKey); err != nil {
+			return nil, fmt.Errorf("email_signing_key: %w", err)
+		}
 	}
 
-	msg := gomail.NewMessage()
-	msg.SetHeader("From", config.SMTPFrom)
-	msg.SetHeader("To", config.SMTPTo)
-	msg.SetHeader("Subject", "Emergency OTP Key '"+key.Name+"' was used on Vault")
-	msg.SetBody("text/plain", fmt.Sprintf(
-		"Emergency OTP Key '%s' was used on Vault at %s.\n"+
-			"Access would be authorized after %d minutes./\n"+
-			"Use \"vault write auth/emerg-yubiotp/key/%s next_eligible_time=-1\" to disable this key.",
-		key.Name, req.Connection.RemoteAddr, key.Delay, key.Name))
-	if err := gomail.NewDialer(config.SMTPHost, config.SMTPPort, config.SMTPUsername, config.SMTPPassword).DialAndSend(msg); err != nil {
-		return false, err
+	var emails []*outgoingEmail
+	var plain []string
+	for _, to := range e.to {
+		r, err := getEmailRecipient(ctx, e.s, to)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil || r.PGPPublicKey == "" {
+			plain = append(plain, to)
+			continue
+		}
+		key, err := readPGPPublicKey(r.PGPPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("OpenPGP key of %s: %w", to, err)
+		}
+		content, err := emailContentEntity(text, html, subject)
+		if err != nil {
+			return nil, err
+		}
+		body, err := pgpEncryptedEntity(content, key, signer)
+		if err != nil {
+			return nil, err
+		}
+		email, err := newOutgoingEmail(e.conf.SMTPFrom, []string{to}, encryptedEmailSubject, body, now)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
 	}
 
-	return true, nil
+	if len(plain) > 0 {
+		body, err := emailContentEntity(text, html, "")
+		if err != nil {
+			return nil, err
+		}
+		if signer != nil {
+			if body, err = pgpSignedEntity(body, signer); err != nil {
+				return nil, err
+			}
+		}
+		email, err := newOutgoingEmail(e.conf.SMTPFrom, plain, subject, body, now)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+
+	if e.conf.DKIMDomain != "" {
+		dkim, err := newDKIMSigner(e.conf)
+		if err != nil {
+			return nil, err
+		}
+		for _, email := range emails {
+			if email.raw, err = dkim.sign(email.raw, now); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return emails, nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+)
+
+const defaultNotifyTimeout = 10 * time.Second
+
+// httpChannelFields adds the settings shared by the channels talking HTTP.
+func httpChannelFields(fields map[string]*framework.FieldSchema) map[string]*framework.FieldSchema {
+	fields["ca_bundle"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "PEM encoded CA bundle replacing the system roots",
+	}
+	fields["timeout"] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "Timeout for a single delivery, defaults to 10s",
+	}
+	return fields
+}
+
+// newNotifyHTTPClient builds the client of an HTTP channel from the settings added by httpChannelFields.
+func newNotifyHTTPClient(settings *framework.FieldData) (*http.Client, error) {
+	caBundle := settings.Get("ca_bundle").(string)
+	timeout := time.Duration(settings.Get("timeout").(int)) * time.Second
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caBundle != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caBundle)) {
+			return nil, errors.New("no certificate found in CA bundle")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if timeout <= 0 {
+		timeout = defaultNotifyTimeout
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// parseNotifyURL checks that a channel URL is absolute http or https.
+func parseNotifyURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, errors.New("url is required")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q: must be http or https", raw)
+	}
+	return u, nil
+}
+
+// doNotifyRequest sends the request and fails unless the answer is 2xx.
+func doNotifyRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := strings.TrimSpace(string(body))
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		return nil, fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, msg)
+	}
+	return body, nil
+}
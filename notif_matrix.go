@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// matrix channels post to a room through the client-server API
+var matrixChannelType = &channelType{
+	Fields: httpChannelFields(map[string]*framework.FieldSchema{
+		"url": {
+			Type:        framework.TypeString,
+			Description: "Homeserver URL",
+		},
+		"room_id": {
+			Type:        framework.TypeString,
+			Description: "ID of the room posted to, e.g. !abcdef:example.com. The user of the token must have joined it",
+		},
+		"token": {
+			Type:        framework.TypeString,
+			Description: "Access token of the posting user",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Sensitive: true,
+			},
+		},
+	}),
+	New: func(conf *emergencyOTPConfig, s logical.Storage, settings *framework.FieldData) (notifier, error) {
+		u, err := parseNotifyURL(settings.Get("url").(string))
+		if err != nil {
+			return nil, err
+		}
+		roomID := settings.Get("room_id").(string)
+		if !strings.HasPrefix(roomID, "!") {
+			return nil, errors.New("room_id must be a room ID starting with !")
+		}
+		token := settings.Get("token").(string)
+		if token == "" {
+			return nil, errors.New("token is required")
+		}
+		client, err := newNotifyHTTPClient(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &matrixNotifier{
+			url:    strings.TrimSuffix(u.String(), "/"),
+			roomID: roomID,
+			token:  token,
+			client: client,
+		}, nil
+	},
+}
+
+type matrixNotifier struct {
+	url    string
+	roomID string
+	token  string
+	client *http.Client
+}
+
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+func newMatrixMessage(n *notification, now time.Time) *matrixMessage {
+	summary := n.summary(now)
+	var formatted strings.Builder
+	formatted.WriteString("<h4>" + html.EscapeString(n.title()) + "</h4>\n<ul>\n")
+	for _, line := range strings.Split(summary, "\n") {
+		label, value, ok := strings.Cut(line, ": ")
+		switch {
+		case !ok:
+			formatted.WriteString("<li>" + html.EscapeString(line) + "</li>\n")
+		case label == "Disable" || label == "Acknowledge":
+			formatted.WriteString("<li><strong>" + label + ":</strong> <code>" + html.EscapeString(value) + "</code></li>\n")
+		default:
+			formatted.WriteString("<li><strong>" + html.EscapeString(label) + ":</strong> " + html.EscapeString(value) + "</li>\n")
+		}
+	}
+	formatted.WriteString("</ul>")
+	return &matrixMessage{
+		MsgType:       "m.text",
+		Body:          n.title() + "\n" + summary,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted.String(),
+	}
+}
+
+// matrixTxnID is the same for every delivery of a notification to a room,
+// so the homeserver drops retries of a message it already has.
+func matrixTxnID(roomID string, n *notification) (string, error) {
+	event, err := json.Marshal(n)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(roomID))
+	h.Write([]byte{0})
+	h.Write(event)
+	return "emerg-yubiotp-" + hex.EncodeToString(h.Sum(nil))[:32], nil
+}
+
+func (m *matrixNotifier) Notify(ctx context.Context, n *notification) error {
+	txnID, err := matrixTxnID(m.roomID, n)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(newMatrixMessage(n, time.Now()))
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		m.url, url.PathEscape(m.roomID), url.PathEscape(txnID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := doNotifyRequest(m.client, req); err != nil {
+		return fmt.Errorf("matrix message failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestMatrixNotification(t *testing.T) {
+	type sent struct {
+		method, path, auth string
+		msg                matrixMessage
+	}
+	received := make(chan sent, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg matrixMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- sent{r.Method, r.URL.EscapedPath(), r.Header.Get("Authorization"), msg}
+		w.Write([]byte(`{"event_id":"$event"}`))
+	}))
+	defer srv.Close()
+
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/oncall", map[string]interface{}{
+		"type":    "matrix",
+		"url":     srv.URL,
+		"room_id": "!oncall:example.com",
+		"token":   "syt_secret",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+		"alias":     "<b>ob</b>",
+		"delay":     60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if denial := testDenial(t, resp, err); denial["notification_sent"] != true {
+		t.Fatalf("matrix message not delivered: %v", denial)
+	}
+	got := <-received
+	prefix := "/_matrix/client/v3/rooms/%21oncall:example.com/send/m.room.message/emerg-yubiotp-"
+	if got.method != http.MethodPut || !strings.HasPrefix(got.path, prefix) || got.auth != "Bearer syt_secret" {
+		t.Errorf("unexpected request %s %s %s", got.method, got.path, got.auth)
+	}
+	if got.msg.Format != "org.matrix.custom.html" || !strings.Contains(got.msg.Body, "somebody") ||
+		!strings.Contains(got.msg.FormattedBody, "&lt;b&gt;ob&lt;/b&gt;") ||
+		!strings.Contains(got.msg.FormattedBody, "<code>vault write auth/emerg-yubiotp/key/somebody next_eligible_time=-1</code>") {
+		t.Errorf("unexpected message %+v", got.msg)
+	}
+
+	// a retry of the same notification reuses the transaction
+	n := &notification{Event: eventLogin, Time: 1683491419, KeyName: "somebody", PublicID: testPublicID}
+	m := &matrixNotifier{url: srv.URL, roomID: "!oncall:example.com", token: "syt_secret", client: srv.Client()}
+	for i := 0; i < 2; i++ {
+		if err := m.Notify(context.Background(), n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first, second := <-received, <-received; first.path != second.path || first.path == got.path {
+		t.Errorf("unexpected transactions %s %s", first.path, second.path)
+	}
+}
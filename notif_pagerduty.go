@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+var pagerDutySeverities = []string{"critical", "error", "warning", "info"}
+
+// pagerduty channels open an incident per activation through the Events API v2
+// and acknowledge or resolve it as the activation request moves on
+var pagerDutyChannelType = &channelType{
+	Fields: httpChannelFields(map[string]*framework.FieldSchema{
+		"routing_key": {
+			Type:        framework.TypeString,
+			Description: "Integration key of the PagerDuty service",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Sensitive: true,
+			},
+		},
+		"url": {
+			Type:        framework.TypeString,
+			Description: "Events API URL, defaults to " + pagerDutyEventsURL,
+		},
+		"severity": {
+			Type:        framework.TypeString,
+			Description: "Severity of activation incidents: critical, error, warning or info. Defaults to critical",
+		},
+	}),
+	New: func(conf *emergencyOTPConfig, s logical.Storage, settings *framework.FieldData) (notifier, error) {
+		routingKey := settings.Get("routing_key").(string)
+		if routingKey == "" {
+			return nil, errors.New("routing_key is required")
+		}
+		eventsURL := settings.Get("url").(string)
+		if eventsURL == "" {
+			eventsURL = pagerDutyEventsURL
+		}
+		u, err := parseNotifyURL(eventsURL)
+		if err != nil {
+			return nil, err
+		}
+		severity := settings.Get("severity").(string)
+		if severity == "" {
+			severity = "critical"
+		}
+		if !strutil.StrListContains(pagerDutySeverities, severity) {
+			return nil, fmt.Errorf("invalid severity %q", severity)
+		}
+		client, err := newNotifyHTTPClient(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &pagerDutyNotifier{
+			url:        u.String(),
+			routingKey: routingKey,
+			severity:   severity,
+			client:     client,
+		}, nil
+	},
+}
+
+type pagerDutyNotifier struct {
+	url        string
+	routingKey string
+	severity   string
+	client     *http.Client
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Timestamp     string                 `json:"timestamp"`
+	Component     string                 `json:"component"`
+	Group         string                 `json:"group,omitempty"`
+	Class         string                 `json:"class"`
+	CustomDetails map[string]interface{} `json:"custom_details"`
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+// pagerDutyDedupKey names the incident of an activation, so later state changes find it.
+func pagerDutyDedupKey(n *notification) string {
+	activation := n.RequestID
+	if activation == "" {
+		activation = strconv.FormatInt(n.NextEligibleTime, 10)
+	}
+	return "emerg-yubiotp/" + n.KeyName + "/" + activation
+}
+
+func (p *pagerDutyNotifier) event(n *notification) *pagerDutyEvent {
+	ev := &pagerDutyEvent{
+		RoutingKey:  p.routingKey,
+		EventAction: "trigger",
+		DedupKey:    pagerDutyDedupKey(n),
+	}
+	switch {
+	case n.Event == eventLogin, n.Event == eventRequest && n.RequestState == requestStateConsumed:
+		// somebody is on it
+		ev.EventAction = "acknowledge"
+		return ev
+	case n.Event == eventRequest && (n.RequestState == requestStateExpired || n.RequestState == requestStateCancelled):
+		ev.EventAction = "resolve"
+		return ev
+	}
+
+	severity := p.severity
+	if n.Event == eventSecurity {
+		// every security event is an incident of its own
+		ev.DedupKey = fmt.Sprintf("emerg-yubiotp/%s/security/%s/%d", n.PublicID, n.Security.Type, n.Security.Time)
+		severity = "warning"
+		if n.Security.Severity == severityCritical {
+			severity = "critical"
+		}
+	}
+	details := map[string]interface{}{
+		"key":                n.KeyName,
+		"alias":              n.KeyAlias,
+		"public_id":          n.PublicID,
+		"entity_id":          n.EntityID,
+		"source_address":     n.RemoteAddr,
+		"request_id":         n.RequestID,
+		"access":             n.countdown(time.Now()),
+		"disable_command":    n.disableCommand(),
+		"delay_minutes":      n.Delay,
+		"delay_mail_minutes": n.DelayMail,
+	}
+	if n.Security != nil {
+		details["security_event"] = n.Security
+	}
+	ev.Payload = &pagerDutyPayload{
+		Summary:       n.title(),
+		Source:        "vault " + n.MountPoint,
+		Severity:      severity,
+		Timestamp:     time.Unix(n.Time, 0).UTC().Format(time.RFC3339),
+		Component:     "emerg-yubiotp",
+		Group:         n.KeyName,
+		Class:         n.Event,
+		CustomDetails: details,
+	}
+	return ev
+}
+
+func (p *pagerDutyNotifier) Notify(ctx context.Context, n *notification) error {
+	body, err := json.Marshal(p.event(n))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := doNotifyRequest(p.client, req); err != nil {
+		return fmt.Errorf("PagerDuty event failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestPagerDutyIncidentLifecycle(t *testing.T) {
+	var events []pagerDutyEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev pagerDutyEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil || ev.RoutingKey != "R0UT1NG" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events = append(events, ev)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "success", "dedup_key": ev.DedupKey})
+	}))
+	defer srv.Close()
+
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/pd", map[string]interface{}{
+		"type":        "pagerduty",
+		"url":         srv.URL + "/v2/enqueue",
+		"routing_key": "R0UT1NG",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	resp, err := testRequest(b, s, logical.ReadOperation, "notify/pd", nil)
+	if err != nil || resp.Data["routing_key"] != "********" {
+		t.Errorf("routing key not masked: %v %v", resp, err)
+	}
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+		"delay":     60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := testPendingRequest(t, b, s, verifier, 1)
+
+	// granted by an operator, then used
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"next_eligible_time": "1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	otp := testOTP(testPublicID, 2)
+	verifier.add(otp, otpStatusOK, 1, 2)
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp}); err != nil || resp.Auth == nil {
+		t.Fatalf("expected login, got %v %v", resp, err)
+	}
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"next_eligible_time": "-1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var actions []string
+	for _, ev := range events {
+		if ev.DedupKey != "emerg-yubiotp/somebody/"+id {
+			t.Errorf("unexpected dedup key %q", ev.DedupKey)
+		}
+		actions = append(actions, ev.EventAction)
+	}
+	want := []string{"trigger", "acknowledge", "acknowledge", "resolve"}
+	if len(actions) != len(want) {
+		t.Fatalf("expected %v, got %v", want, actions)
+	}
+	for i := range want {
+		if actions[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, actions)
+		}
+	}
+	if events[0].Payload == nil || events[0].Payload.Severity != "critical" || events[0].Payload.Group != "somebody" {
+		t.Errorf("unexpected trigger payload %+v", events[0].Payload)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const ntfyDefaultURL = "https://ntfy.sh"
+
+// priority classes of notifications, see notification.priorityClass
+var pushPriorityClasses = []string{eventActivation, eventReminder, eventEligible, "unknown_key", eventSecurity, eventLogin, eventRequest}
+
+// ntfy priorities run from 1 (min) to 5 (max)
+var ntfyDefaultPriorities = map[string]int{
+	eventActivation: 5,
+	eventReminder:   4,
+	eventEligible:   4,
+	"unknown_key":   3,
+	eventSecurity:   5,
+	eventLogin:      4,
+	eventRequest:    3,
+}
+
+// gotify priorities run from 0 to 10, clients alert from 8 on by default
+var gotifyDefaultPriorities = map[string]int{
+	eventActivation: 8,
+	eventReminder:   6,
+	eventEligible:   7,
+	"unknown_key":   4,
+	eventSecurity:   9,
+	eventLogin:      7,
+	eventRequest:    5,
+}
+
+func pushChannelFields(fields map[string]*framework.FieldSchema) map[string]*framework.FieldSchema {
+	fields["token"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Access token of the push server",
+		DisplayAttrs: &framework.DisplayAttributes{
+			Sensitive: true,
+		},
+	}
+	fields["priorities"] = &framework.FieldSchema{
+		Type: framework.TypeKVPairs,
+		Description: "Priority per notification class (" + strings.Join(pushPriorityClasses, ", ") +
+			"), e.g. unknown_key=2. Unset classes keep the defaults of the channel type",
+	}
+	return httpChannelFields(fields)
+}
+
+// pushPriorities applies the priorities setting on top of the defaults.
+func pushPriorities(settings *framework.FieldData, defaults map[string]int, min, max int) (map[string]int, error) {
+	priorities := make(map[string]int, len(defaults))
+	for class, p := range defaults {
+		priorities[class] = p
+	}
+	for class, v := range settings.Get("priorities").(map[string]string) {
+		if _, ok := defaults[class]; !ok {
+			return nil, fmt.Errorf("invalid priority class %q, must be one of %s", class, strings.Join(pushPriorityClasses, ", "))
+		}
+		p, err := strconv.Atoi(v)
+		if err != nil || p < min || p > max {
+			return nil, fmt.Errorf("priority of %s must be between %d and %d", class, min, max)
+		}
+		priorities[class] = p
+	}
+	return priorities, nil
+}
+
+func postPushJSON(ctx context.Context, client *http.Client, url string, header http.Header, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = doNotifyRequest(client, req)
+	return err
+}
+
+// ntfy channels publish to a topic of an ntfy server
+var ntfyChannelType = &channelType{
+	Fields: pushChannelFields(map[string]*framework.FieldSchema{
+		"url": {
+			Type:        framework.TypeString,
+			Description: "Server URL, defaults to " + ntfyDefaultURL,
+		},
+		"topic": {
+			Type:        framework.TypeString,
+			Description: "ntfy topic the notifications are published to",
+		},
+	}),
+	New: func(conf *emergencyOTPConfig, s logical.Storage, settings *framework.FieldData) (notifier, error) {
+		serverURL := settings.Get("url").(string)
+		if serverURL == "" {
+			serverURL = ntfyDefaultURL
+		}
+		u, err := parseNotifyURL(serverURL)
+		if err != nil {
+			return nil, err
+		}
+		topic := settings.Get("topic").(string)
+		if topic == "" {
+			return nil, errors.New("topic is required")
+		}
+		priorities, err := pushPriorities(settings, ntfyDefaultPriorities, 1, 5)
+		if err != nil {
+			return nil, err
+		}
+		client, err := newNotifyHTTPClient(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &ntfyNotifier{
+			url:        strings.TrimSuffix(u.String(), "/"),
+			topic:      topic,
+			token:      settings.Get("token").(string),
+			priorities: priorities,
+			client:     client,
+		}, nil
+	},
+}
+
+type ntfyNotifier struct {
+	url        string
+	topic      string
+	token      string
+	priorities map[string]int
+	client     *http.Client
+}
+
+type ntfyMessage struct {
+	Topic    string   `json:"topic"`
+	Title    string   `json:"title"`
+	Message  string   `json:"message"`
+	Priority int      `json:"priority"`
+	Tags     []string `json:"tags"`
+}
+
+func (p *ntfyNotifier) Notify(ctx context.Context, n *notification) error {
+	class := n.priorityClass()
+	msg := &ntfyMessage{
+		Topic:    p.topic,
+		Title:    n.title(),
+		Message:  n.summary(time.Now()),
+		Priority: p.priorities[class],
+		Tags:     []string{"key", "emerg-yubiotp", class},
+	}
+	if n.Event == eventSecurity {
+		msg.Tags[0] = "warning"
+	}
+	header := make(http.Header)
+	if p.token != "" {
+		header.Set("Authorization", "Bearer "+p.token)
+	}
+	// publishing JSON goes to the server root, the topic is in the message
+	if err := postPushJSON(ctx, p.client, p.url+"/", header, msg); err != nil {
+		return fmt.Errorf("ntfy publish failed: %w", err)
+	}
+	return nil
+}
+
+// gotify channels send to the application of an app token
+var gotifyChannelType = &channelType{
+	Fields: pushChannelFields(map[string]*framework.FieldSchema{
+		"url": {
+			Type:        framework.TypeString,
+			Description: "Server URL",
+		},
+	}),
+	New: func(conf *emergencyOTPConfig, s logical.Storage, settings *framework.FieldData) (notifier, error) {
+		u, err := parseNotifyURL(settings.Get("url").(string))
+		if err != nil {
+			return nil, err
+		}
+		// the app token picks the gotify application messages show up under
+		token := settings.Get("token").(string)
+		if token == "" {
+			return nil, errors.New("token is required")
+		}
+		priorities, err := pushPriorities(settings, gotifyDefaultPriorities, 0, 10)
+		if err != nil {
+			return nil, err
+		}
+		client, err := newNotifyHTTPClient(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &gotifyNotifier{
+			url:        strings.TrimSuffix(u.String(), "/") + "/message",
+			token:      token,
+			priorities: priorities,
+			client:     client,
+		}, nil
+	},
+}
+
+type gotifyNotifier struct {
+	url        string
+	token      string
+	priorities map[string]int
+	client     *http.Client
+}
+
+type gotifyMessage struct {
+	Title    string                 `json:"title"`
+	Message  string                 `json:"message"`
+	Priority int                    `json:"priority"`
+	Extras   map[string]interface{} `json:"extras"`
+}
+
+func (p *gotifyNotifier) Notify(ctx context.Context, n *notification) error {
+	msg := &gotifyMessage{
+		Title:    n.title(),
+		Message:  n.summary(time.Now()),
+		Priority: p.priorities[n.priorityClass()],
+		Extras: map[string]interface{}{
+			"client::display":             map[string]string{"contentType": "text/plain"},
+			"emerg-yubiotp::notification": n,
+		},
+	}
+	header := make(http.Header)
+	header.Set("X-Gotify-Key", p.token)
+	if err := postPushJSON(ctx, p.client, p.url, header, msg); err != nil {
+		return fmt.Errorf("gotify message failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+type testPushMessage struct {
+	header http.Header
+	path   string
+	body   map[string]interface{}
+}
+
+func testPushServer(t *testing.T) (*httptest.Server, chan testPushMessage) {
+	messages := make(chan testPushMessage, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		messages <- testPushMessage{header: r.Header, path: r.URL.Path, body: body}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, messages
+}
+
+func TestPushNotificationPriorities(t *testing.T) {
+	ntfy, ntfyMessages := testPushServer(t)
+	gotify, gotifyMessages := testPushServer(t)
+
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	for name, data := range map[string]map[string]interface{}{
+		"phone": {
+			"type":       "ntfy",
+			"url":        ntfy.URL,
+			"topic":      "vault-emergency",
+			"token":      "tk_secret",
+			"priorities": "unknown_key=2",
+		},
+		"desktop": {
+			"type":  "gotify",
+			"url":   gotify.URL + "/",
+			"token": "app-token",
+		},
+	} {
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/"+name, data); err != nil || resp.IsError() {
+			t.Fatalf("failed to create channel %s: %v %v", name, resp, err)
+		}
+	}
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+		"delay":     60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if denial := testDenial(t, resp, err); denial["notification_sent"] != true {
+		t.Fatalf("push notifications not delivered: %v", denial)
+	}
+	msg := <-ntfyMessages
+	if msg.path != "/" || msg.header.Get("Authorization") != "Bearer tk_secret" ||
+		msg.body["topic"] != "vault-emergency" || msg.body["priority"] != float64(5) ||
+		!strings.Contains(msg.body["message"].(string), "Disable: vault write auth/emerg-yubiotp/key/somebody") {
+		t.Errorf("unexpected ntfy message %+v", msg)
+	}
+	msg = <-gotifyMessages
+	if msg.path != "/message" || msg.header.Get("X-Gotify-Key") != "app-token" || msg.body["priority"] != float64(8) {
+		t.Errorf("unexpected gotify message %+v", msg)
+	}
+
+	// a key that is not enrolled is a probe
+	probe := testOTP("vvdddddddddd", 1)
+	verifier.add(probe, otpStatusOK, 1, 1)
+	resp, err = testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": probe})
+	if denial := testDenial(t, resp, err); denial["reason"] != denyReasonNotEnrolled {
+		t.Fatalf("unexpected denial %v", denial)
+	}
+	if msg := <-ntfyMessages; msg.body["priority"] != float64(2) || !strings.Contains(msg.body["title"].(string), "unknown YubiKey") {
+		t.Errorf("unexpected ntfy message %+v", msg)
+	}
+	if msg := <-gotifyMessages; msg.body["priority"] != float64(4) {
+		t.Errorf("unexpected gotify message %+v", msg)
+	}
+}
+
+func TestPushRejectsBadSettings(t *testing.T) {
+	b, s := testBackend(t)
+	for _, data := range []map[string]interface{}{
+		{"type": "ntfy"},
+		{"type": "ntfy", "topic": "alerts", "priorities": "activation=9"},
+		{"type": "ntfy", "topic": "alerts", "priorities": "lunch=1"},
+		{"type": "gotify", "url": "https://gotify.example.com"},
+		{"type": "gotify", "token": "app-token"},
+	} {
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/push", data); err != nil || !resp.IsError() {
+			t.Errorf("expected %v to be rejected, got %v %v", data, resp, err)
+		}
+	}
+}
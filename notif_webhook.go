@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// version of the webhook payload, bumped on incompatible changes
+const webhookPayloadVersion = 1
+
+// the body is signed with HMAC-SHA256 of the secret, sent as sha256=<hex>
+const webhookSignatureHeader = "X-Emerg-Yubiotp-Signature"
+
+var webhookChannelType = &channelType{
+	Fields: httpChannelFields(map[string]*framework.FieldSchema{
+		"url": {
+			Type:        framework.TypeString,
+			Description: "URL the events are posted to",
+		},
+		"secret": {
+			Type:        framework.TypeString,
+			Description: "Secret the body is signed with, sent in the " + webhookSignatureHeader + " header",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Sensitive: true,
+			},
+		},
+		"headers": {
+			Type:        framework.TypeKVPairs,
+			Description: "Additional headers, e.g. headers=Authorization=\"Bearer xxx\". Their values are not shown on read",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Sensitive: true,
+			},
+		},
+	}),
+	New: func(conf *emergencyOTPConfig, s logical.Storage, settings *framework.FieldData) (notifier, error) {
+		u, err := parseNotifyURL(settings.Get("url").(string))
+		if err != nil {
+			return nil, err
+		}
+		client, err := newNotifyHTTPClient(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &webhookNotifier{
+			url:     u.String(),
+			secret:  settings.Get("secret").(string),
+			headers: settings.Get("headers").(map[string]string),
+			client:  client,
+		}, nil
+	},
+}
+
+type webhookNotifier struct {
+	url     string
+	secret  string
+	headers map[string]string
+	client  *http.Client
+}
+
+type webhookKey struct {
+	Name     string `json:"name"`
+	Alias    string `json:"alias"`
+	PublicID string `json:"public_id"`
+	EntityID string `json:"entity_id"`
+}
+
+type webhookPayload struct {
+	Version    int    `json:"version"`
+	Event      string `json:"event"`
+	Time       string `json:"time"`
+	MountPoint string `json:"mount_point"`
+	// nil if the key is not enrolled
+	Key           *webhookKey `json:"key"`
+	PublicID      string      `json:"public_id"`
+	SourceAddress string      `json:"source_address"`
+	// empty while the key waits for an operator
+	NextEligibleTime     string         `json:"next_eligible_time"`
+	NextEligibleTimeUnix int64          `json:"next_eligible_time_unix"`
+	DelayMinutes         int64          `json:"delay_minutes"`
+	DelayMailMinutes     int64          `json:"delay_mail_minutes"`
+	RequestID            string         `json:"request_id"`
+	RequestState         string         `json:"request_state,omitempty"`
+	Security             *securityEvent `json:"security,omitempty"`
+	// notifications of the same kind held back since the previous one
+	FurtherAttempts int `json:"further_attempts,omitempty"`
+	// set if an escalation policy sent the notification
+	EscalationID   string `json:"escalation_id,omitempty"`
+	EscalationTier int    `json:"escalation_tier,omitempty"`
+}
+
+func newWebhookPayload(n *notification) *webhookPayload {
+	p := &webhookPayload{
+		Version:              webhookPayloadVersion,
+		Event:                n.Event,
+		Time:                 time.Unix(n.Time, 0).UTC().Format(time.RFC3339),
+		MountPoint:           n.MountPoint,
+		PublicID:             n.PublicID,
+		SourceAddress:        n.RemoteAddr,
+		NextEligibleTimeUnix: n.NextEligibleTime,
+		DelayMinutes:         n.Delay,
+		DelayMailMinutes:     n.DelayMail,
+		RequestID:            n.RequestID,
+		RequestState:         n.RequestState,
+		Security:             n.Security,
+		FurtherAttempts:      n.FurtherAttempts,
+		EscalationID:         n.EscalationID,
+		EscalationTier:       n.EscalationTier,
+	}
+	if n.KeyName != "" {
+		p.Key = &webhookKey{
+			Name:     n.KeyName,
+			Alias:    n.KeyAlias,
+			PublicID: n.PublicID,
+			EntityID: n.EntityID,
+		}
+	}
+	if n.NextEligibleTime > 0 {
+		p.NextEligibleTime = time.Unix(n.NextEligibleTime, 0).UTC().Format(time.RFC3339)
+	}
+	return p
+}
+
+// webhookSignature is the value of the signature header for the body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, n *notification) error {
+	body, err := json.Marshal(newWebhookPayload(n))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "vault-auth-emerg-yubiotp")
+	if w.secret != "" {
+		req.Header.Set(webhookSignatureHeader, webhookSignature(w.secret, body))
+	}
+	if _, err := doNotifyRequest(w.client, req); err != nil {
+		return fmt.Errorf("webhook failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestWebhookNotification(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+	caBundle := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/incidents", map[string]interface{}{
+		"type":      "webhook",
+		"url":       srv.URL + "/hook",
+		"secret":    "hunter2",
+		"headers":   []string{"X-Team=security"},
+		"ca_bundle": caBundle,
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	resp, err := testRequest(b, s, logical.ReadOperation, "notify/incidents", nil)
+	if err != nil || resp.Data["secret"] != "********" || resp.Data["headers"].(map[string]string)["X-Team"] != "********" {
+		t.Errorf("secret not masked: %v %v", resp, err)
+	}
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":  testPublicID,
+		"entity_id":  "entity-1",
+		"delay":      60,
+		"delay_mail": 30,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err = testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if denial := testDenial(t, resp, err); denial["notification_sent"] != true {
+		t.Fatalf("webhook not delivered: %v", denial)
+	}
+
+	r, body := <-received, <-bodies
+	if r.URL.Path != "/hook" || r.Header.Get("X-Team") != "security" || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected request %s %v", r.URL, r.Header)
+	}
+	if sig := r.Header.Get(webhookSignatureHeader); sig != webhookSignature("hunter2", body) {
+		t.Errorf("bad signature %q", sig)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Version != webhookPayloadVersion || payload.Event != eventActivation || payload.Key == nil ||
+		payload.Key.Name != "somebody" || payload.Key.EntityID != "entity-1" || payload.SourceAddress != "192.0.2.1" ||
+		payload.DelayMinutes != 60 || payload.DelayMailMinutes != 30 {
+		t.Errorf("unexpected payload %s", body)
+	}
+}
+
+func TestWebhookRejectsBadSettings(t *testing.T) {
+	b, s := testBackend(t)
+	for _, data := range []map[string]interface{}{
+		{"type": "webhook"},
+		{"type": "webhook", "url": "ftp://example.com"},
+		{"type": "webhook", "url": "https://example.com", "ca_bundle": "not a certificate"},
+	} {
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/hook", data); err != nil || !resp.IsError() {
+			t.Errorf("expected %v to be rejected, got %v %v", data, resp, err)
+		}
+	}
+}
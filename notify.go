@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// notification events channels can subscribe to
+const (
+	// an emergency key was used and is waiting to become eligible
+	eventActivation = "activation"
+	// a token was issued to an emergency key
+	eventLogin = "login"
+	// something suspicious was observed, see securityEvent
+	eventSecurity = "security"
+	// an activation request became eligible, was consumed, expired or was cancelled
+	eventRequest = "request"
+	// a waiting key becomes eligible soon, see emergencyOTPConfig.Reminders
+	eventReminder = "reminder"
+	// the waiting period of a key is over, it can be used to log in
+	eventEligible = "eligible"
+)
+
+var notifyEvents = []string{eventActivation, eventLogin, eventSecurity, eventRequest, eventReminder, eventEligible}
+
+// the channel made up from smtp_to in the mount config
+const defaultEmailChannel = "default-email"
+
+// channel of the owner_email of a key
+const ownerEmailChannel = "owner-email"
+
+// notification is what is sent out to the channels.
+type notification struct {
+	Event      string `json:"event"`
+	Time       int64  `json:"time"`
+	MountPoint string `json:"mount_point"`
+	RemoteAddr string `json:"remote_addr"`
+
+	// empty if the key is not enrolled
+	KeyName          string `json:"key_name"`
+	KeyAlias         string `json:"key_alias"`
+	PublicID         string `json:"public_id"`
+	EntityID         string `json:"entity_id"`
+	Delay            int64  `json:"delay"`
+	DelayMail        int64  `json:"delay_mail"`
+	NextEligibleTime int64  `json:"next_eligible_time"`
+	RequestID        string `json:"request_id"`
+	// only for request notifications
+	RequestState string `json:"request_state,omitempty"`
+
+	// only for security notifications
+	Security *securityEvent `json:"security,omitempty"`
+	// addressed to the owner of the key
+	Owner bool `json:"owner,omitempty"`
+	// notifications of the same kind held back since the previous one, see notifyThrottle
+	FurtherAttempts int `json:"further_attempts,omitempty"`
+	// set on notifications sent by an escalation policy, see escalation
+	EscalationID   string `json:"escalation_id,omitempty"`
+	EscalationTier int    `json:"escalation_tier,omitempty"`
+}
+
+func newNotification(req *logical.Request, event string, key *keyState) *notification {
+	n := &notification{
+		Event:      event,
+		Time:       time.Now().Unix(),
+		MountPoint: req.MountPoint,
+	}
+	if req.Connection != nil {
+		n.RemoteAddr = req.Connection.RemoteAddr
+	}
+	if key != nil {
+		n.KeyName = key.Name
+		n.KeyAlias = key.Alias
+		n.PublicID = key.PublicID
+		n.EntityID = key.EntityID
+		n.Delay = key.Delay
+		n.DelayMail = key.DelayMail
+		n.NextEligibleTime = key.NextEligibleTime
+		n.RequestID = key.ActiveRequest
+	}
+	return n
+}
+
+// disableCommand is the command an operator runs to stop the key.
+func (n *notification) disableCommand() string {
+	mountPoint := n.MountPoint
+	if mountPoint == "" {
+		mountPoint = "auth/emerg-yubiotp/"
+	}
+	return fmt.Sprintf("vault write %skey/%s next_eligible_time=-1", mountPoint, n.KeyName)
+}
+
+// ackCommand is the command a recipient runs to stop the escalation of the notification.
+func (n *notification) ackCommand() string {
+	mountPoint := n.MountPoint
+	if mountPoint == "" {
+		mountPoint = "auth/emerg-yubiotp/"
+	}
+	return fmt.Sprintf("vault write -f %sescalation/%s/ack", mountPoint, n.EscalationID)
+}
+
+// title is a one line summary for channels without a subject of their own.
+func (n *notification) title() string {
+	title := n.headline()
+	if n.FurtherAttempts > 0 {
+		title = fmt.Sprintf("%s (%d further attempts)", title, n.FurtherAttempts)
+	}
+	if n.EscalationTier > 1 {
+		title = fmt.Sprintf("%s (escalated to tier %d)", title, n.EscalationTier)
+	}
+	return title
+}
+
+func (n *notification) headline() string {
+	switch n.Event {
+	case eventSecurity:
+		if n.KeyName == "" {
+			return fmt.Sprintf("[%s] Security alert for unknown YubiKey '%s' on Vault", strings.ToUpper(n.Security.Severity), n.PublicID)
+		}
+		if n.Owner {
+			return fmt.Sprintf("[%s] Security alert for your Emergency OTP Key '%s' on Vault", strings.ToUpper(n.Security.Severity), n.KeyName)
+		}
+		return fmt.Sprintf("[%s] Security alert for Emergency OTP Key '%s' on Vault", strings.ToUpper(n.Security.Severity), n.KeyName)
+	case eventLogin:
+		if n.Owner {
+			return fmt.Sprintf("Your Emergency OTP Key '%s' was used to log in to Vault", n.KeyName)
+		}
+		return fmt.Sprintf("Emergency OTP Key '%s' was used to log in to Vault", n.KeyName)
+	case eventRequest:
+		return fmt.Sprintf("Activation of Emergency OTP Key '%s' on Vault is %s", n.KeyName, n.RequestState)
+	case eventReminder:
+		in := shortDuration(time.Duration(n.NextEligibleTime-n.Time) * time.Second)
+		if n.Owner {
+			return fmt.Sprintf("Your Emergency OTP Key '%s' becomes eligible on Vault in %s", n.KeyName, in)
+		}
+		return fmt.Sprintf("Emergency OTP Key '%s' becomes eligible on Vault in %s", n.KeyName, in)
+	case eventEligible:
+		if n.Owner {
+			return fmt.Sprintf("Your Emergency OTP Key '%s' can now be used to log in to Vault", n.KeyName)
+		}
+		return fmt.Sprintf("Emergency OTP Key '%s' can now be used to log in to Vault", n.KeyName)
+	default:
+		if n.Owner {
+			return fmt.Sprintf("Your Emergency OTP Key '%s' was used on Vault", n.KeyName)
+		}
+		return fmt.Sprintf("Emergency OTP Key '%s' was used on Vault", n.KeyName)
+	}
+}
+
+// shortDuration formats d in hours and minutes, e.g. 6h or 1h30m.
+func shortDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	hours, minutes := int64(d/time.Hour), int64(d%time.Hour/time.Minute)
+	switch {
+	case hours == 0:
+		return fmt.Sprintf("%dm", minutes)
+	case minutes == 0:
+		return fmt.Sprintf("%dh", hours)
+	}
+	return fmt.Sprintf("%dh%dm", hours, minutes)
+}
+
+// countdown tells when the key becomes eligible, relative to now.
+func (n *notification) countdown(now time.Time) string {
+	if n.NextEligibleTime <= 0 {
+		return "waiting for an operator"
+	}
+	at := time.Unix(n.NextEligibleTime, 0)
+	if !at.After(now) {
+		return "eligible now"
+	}
+	return fmt.Sprintf("in %s (at %s)", at.Sub(now).Round(time.Minute), at.UTC().Format(time.RFC3339))
+}
+
+// priorityClass groups notifications that push channels prioritize differently.
+// It is the event name, except unknown_key for security events of keys not on file.
+func (n *notification) priorityClass() string {
+	if n.Event == eventSecurity && n.KeyName == "" {
+		return "unknown_key"
+	}
+	return n.Event
+}
+
+// summary is a plain text body for channels that show a title and a short message.
+func (n *notification) summary(now time.Time) string {
+	var lines []string
+	if n.KeyName != "" {
+		key := n.KeyName
+		if n.KeyAlias != "" {
+			key += " (" + n.KeyAlias + ")"
+		}
+		lines = append(lines, "Key: "+key)
+	}
+	lines = append(lines, "Public ID: "+n.PublicID, "From: "+n.RemoteAddr)
+	switch n.Event {
+	case eventActivation, eventReminder, eventEligible:
+		lines = append(lines, "Access: "+n.countdown(now))
+	case eventRequest:
+		lines = append(lines, "State: "+n.RequestState)
+	case eventSecurity:
+		lines = append(lines, securityEventDescriptions[n.Security.Type], "Details: "+n.Security.Detail)
+	}
+	if n.FurtherAttempts > 0 {
+		lines = append(lines, fmt.Sprintf("Further attempts: %d since the previous notification", n.FurtherAttempts))
+	}
+	if n.KeyName != "" {
+		lines = append(lines, "Disable: "+n.disableCommand())
+	}
+	if n.EscalationID != "" {
+		lines = append(lines, "Acknowledge: "+n.ackCommand())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// notifier delivers notifications to one channel.
+type notifier interface {
+	Notify(ctx context.Context, n *notification) error
+}
+
+// channelType is a kind of notification channel, e.g. email.
+type channelType struct {
+	// settings accepted by notify/<name> for this type
+	Fields map[string]*framework.FieldSchema
+	// New builds the notifier of a channel, it fails if the settings are not usable.
+	// s is the storage of the mount, for channels that look up more than their settings.
+	New func(conf *emergencyOTPConfig, s logical.Storage, settings *framework.FieldData) (notifier, error)
+}
+
+var channelTypes = map[string]*channelType{
+	"email":      emailChannelType,
+	"webhook":    webhookChannelType,
+	"slack":      chatChannelType,
+	"mattermost": chatChannelType,
+	"pagerduty":  pagerDutyChannelType,
+	"ntfy":       ntfyChannelType,
+	"gotify":     gotifyChannelType,
+	"matrix":     matrixChannelType,
+}
+
+// notifyChannel is a configured destination for notifications.
+type notifyChannel struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// empty to receive every event
+	Events []string `json:"events"`
+	// seconds repeated notifications of a key are held back, defaultNotifyThrottle if nil
+	Throttle *int64 `json:"throttle,omitempty"`
+	// escalations skip the channel in its quiet hours, see parseQuietHours
+	QuietHours string `json:"quiet_hours,omitempty"`
+	TimeZone   string `json:"time_zone,omitempty"`
+	// type specific settings, see channelType.Fields
+	Settings map[string]interface{} `json:"settings"`
+
+	// notifications are addressed to the key owner, only set on owner-email
+	owner bool
+}
+
+func (c *notifyChannel) subscribed(event string) bool {
+	return len(c.Events) == 0 || strutil.StrListContains(c.Events, event)
+}
+
+func (c *notifyChannel) throttle() time.Duration {
+	if c.Throttle == nil {
+		return defaultNotifyThrottle
+	}
+	return time.Duration(*c.Throttle) * time.Second
+}
+
+func (c *notifyChannel) settings() *framework.FieldData {
+	return &framework.FieldData{
+		Raw:    c.Settings,
+		Schema: channelTypes[c.Type].Fields,
+	}
+}
+
+func (c *notifyChannel) notifier(conf *emergencyOTPConfig, s logical.Storage) (notifier, error) {
+	t, ok := channelTypes[c.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown channel type %q", c.Type)
+	}
+	return t.New(conf, s, c.settings())
+}
+
+// notifyResult is the outcome of sending a notification to one channel.
+type notifyResult struct {
+	// of the outbox entry, see notifications/
+	ID      string `json:"id"`
+	Channel string `json:"channel"`
+	Type    string `json:"type"`
+	Sent    bool   `json:"sent"`
+	Error   string `json:"error,omitempty"`
+	// held back, the channel got the same notification recently
+	Throttled bool `json:"throttled,omitempty"`
+	// set if the channel was notified as a tier of an escalation policy
+	EscalationTier int `json:"escalation_tier,omitempty"`
+}
+
+func getNotifyChannel(ctx context.Context, s logical.Storage, name string) (*notifyChannel, error) {
+	entry, err := s.Get(ctx, "notify/"+name)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var c notifyChannel
+	if err := entry.DecodeJSON(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// notifyChannels lists the channels a notification may go to: the email channels made up
+// from the mount config and the key first, then the ones of the mount.
+func (b *backend) notifyChannels(ctx context.Context, s logical.Storage, conf *emergencyOTPConfig, n *notification) ([]*notifyChannel, error) {
+	var key *keyState
+	if n.KeyName != "" {
+		var err error
+		if key, err = b.key(ctx, s, n.KeyName); err != nil {
+			return nil, err
+		}
+	}
+
+	var channels []*notifyChannel
+	// the owner gets a message of their own, the other recipients of the mount and the key share one
+	owner := ""
+	if key != nil {
+		owner = key.OwnerEmail
+	}
+	var to []string
+	seen := map[string]bool{recipientAddress(owner): true}
+	recipients := strings.Split(conf.SMTPTo, ",")
+	if key != nil {
+		recipients = append(recipients, key.Recipients...)
+	}
+	for _, r := range recipients {
+		r = strings.TrimSpace(r)
+		if r != "" && !seen[recipientAddress(r)] {
+			seen[recipientAddress(r)] = true
+			to = append(to, r)
+		}
+	}
+	if conf.SMTPHost != "" && len(to) > 0 {
+		channels = append(channels, &notifyChannel{
+			Name:   defaultEmailChannel,
+			Type:   "email",
+			Events: []string{eventActivation, eventSecurity, eventReminder, eventEligible},
+			Settings: map[string]interface{}{
+				"to": to,
+			},
+		})
+	}
+	if conf.SMTPHost != "" && owner != "" {
+		channels = append(channels, &notifyChannel{
+			Name:   ownerEmailChannel,
+			Type:   "email",
+			Events: []string{eventActivation, eventLogin, eventSecurity, eventReminder, eventEligible},
+			Settings: map[string]interface{}{
+				"to": []string{owner},
+			},
+			owner: true,
+		})
+	}
+
+	names, err := s.List(ctx, "notify/")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		c, err := getNotifyChannel(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			channels = append(channels, c)
+		}
+	}
+	return channels, nil
+}
+
+// notify sends the notification to every channel subscribed to its event.
+// Delivery failures are reported in the results, the error is only set if the channels could not be loaded.
+func (b *backend) notify(ctx context.Context, s logical.Storage, n *notification) ([]notifyResult, error) {
+	conf, err := b.config(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	channels, err := b.notifyChannels(ctx, s, conf, n)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var sends []*outgoing
+	var notified []string
+	for _, c := range channels {
+		if !c.subscribed(n.Event) {
+			continue
+		}
+		cn := *n
+		cn.Owner = c.owner
+		throttled, err := b.throttle(ctx, s, conf, c, &cn, now)
+		if err != nil {
+			return nil, err
+		}
+		notified = append(notified, c.Name)
+		o := &outgoing{channel: c, n: &cn}
+		if throttled {
+			o.result = notifyResult{Channel: c.Name, Type: c.Type, Throttled: true}
+		}
+		sends = append(sends, o)
+	}
+
+	// escalations go to their tiers regardless of subscriptions, but not to the channels notified above,
+	// they are sent meanwhile
+	done := make(chan error, 1)
+	go func() {
+		done <- b.sendAll(ctx, s, conf, sends, now)
+	}()
+	escalated, err := b.startEscalations(ctx, s, conf, n, notified, now)
+	if sendErr := <-done; sendErr != nil && err == nil {
+		err = sendErr
+	}
+
+	results := make([]notifyResult, 0, len(sends)+len(escalated))
+	for _, o := range sends {
+		results = append(results, o.result)
+	}
+	results = append(results, escalated...)
+	return results, err
+}
+
+// outgoing is a notification for a channel and what became of it.
+type outgoing struct {
+	channel *notifyChannel
+	n       *notification
+	result  notifyResult
+}
+
+// sendAll sends the outgoing notifications that were not throttled. The first attempts run concurrently,
+// so a slow channel does not hold back the others or the login waiting for them.
+func (b *backend) sendAll(ctx context.Context, s logical.Storage, conf *emergencyOTPConfig, sends []*outgoing, now time.Time) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(sends))
+	for i, o := range sends {
+		if o.result.Throttled {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, o *outgoing) {
+			defer wg.Done()
+			o.result, errs[i] = b.send(ctx, s, conf, o.channel, o.n, now)
+		}(i, o)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send delivers n to the channel through its own entry in the outbox, if it fails now it is retried by periodic.
+func (b *backend) send(ctx context.Context, s logical.Storage, conf *emergencyOTPConfig, c *notifyChannel, n *notification, now time.Time) (notifyResult, error) {
+	d, err := newDelivery(c, n, now)
+	if err != nil {
+		return notifyResult{}, err
+	}
+	// stored before the attempt, if the backend stops while sending periodic picks it up
+	d.NextAttempt = now.Add(deliveryBackoff).Unix()
+	if err := putDelivery(ctx, s, d); err != nil {
+		return notifyResult{}, err
+	}
+	result := notifyResult{ID: d.ID, Channel: c.Name, Type: c.Type}
+	if err := b.deliver(ctx, s, conf, c, d, now); err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Sent = true
+	}
+	if err := putDelivery(ctx, s, d); err != nil {
+		b.Logger().Error("failed to store notification", "id", d.ID, "channel", c.Name, "error", err)
+	}
+	return result, nil
+}
+
+// notifySent tells whether an admin facing channel got the notification: the email to the owner and
+// escalation tiers do not count.
+func notifySent(results []notifyResult) bool {
+	for _, r := range results {
+		if r.Sent && r.Channel != ownerEmailChannel && r.EscalationTier == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyErrors joins the errors of the channels that failed, empty if none did.
+func notifyErrors(results []notifyResult) string {
+	var errs []string
+	for _, r := range results {
+		if r.Error != "" {
+			errs = append(errs, r.Channel+": "+r.Error)
+		}
+	}
+	return strings.Join(errs, "; ")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// memoryNotifier keeps notifications instead of sending them, channels of the "memory" type write to it.
+type memoryNotifier struct {
+	mu   sync.Mutex
+	sent map[string][]*notification
+}
+
+var testNotifier = &memoryNotifier{sent: make(map[string][]*notification)}
+
+func init() {
+	channelTypes["memory"] = &channelType{
+		Fields: map[string]*framework.FieldSchema{
+			"box": {
+				Type:        framework.TypeString,
+				Description: "Where notifications are kept",
+			},
+			"fail": {
+				Type:        framework.TypeBool,
+				Description: "Fail every delivery",
+			},
+			"delay": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Time every delivery takes",
+			},
+		},
+		New: func(conf *emergencyOTPConfig, s logical.Storage, settings *framework.FieldData) (notifier, error) {
+			box := settings.Get("box").(string)
+			if box == "" {
+				return nil, errors.New("box is required")
+			}
+			return &memoryChannel{
+				box:   box,
+				fail:  settings.Get("fail").(bool),
+				delay: time.Duration(settings.Get("delay").(int)) * time.Second,
+			}, nil
+		},
+	}
+}
+
+type memoryChannel struct {
+	box   string
+	fail  bool
+	delay time.Duration
+}
+
+func (c *memoryChannel) Notify(ctx context.Context, n *notification) error {
+	time.Sleep(c.delay)
+	if c.fail {
+		return errors.New("delivery failed")
+	}
+	testNotifier.mu.Lock()
+	defer testNotifier.mu.Unlock()
+	testNotifier.sent[c.box] = append(testNotifier.sent[c.box], n)
+	return nil
+}
+
+func (m *memoryNotifier) take(box string) []*notification {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := m.sent[box]
+	delete(m.sent, box)
+	return sent
+}
+
+func TestNotifyFanOut(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	for name, data := range map[string]map[string]interface{}{
+		"oncall":   {"type": "memory", "box": t.Name() + "-oncall", "events": "activation,login"},
+		"security": {"type": "memory", "box": t.Name() + "-security", "events": "security"},
+		"broken":   {"type": "memory", "box": t.Name() + "-broken", "fail": true},
+	} {
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/"+name, data); err != nil || resp.IsError() {
+			t.Fatalf("failed to create channel %s: %v %v", name, resp, err)
+		}
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/bad", map[string]interface{}{
+		"type": "memory", "events": "nothing",
+	}); err != nil || !resp.IsError() {
+		t.Errorf("expected invalid channel to be rejected, got %v %v", resp, err)
+	}
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":  testPublicID,
+		"delay":      60,
+		"delay_mail": 30,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	denial := testDenial(t, resp, err)
+	if denial["notification_sent"] != true {
+		t.Errorf("expected notification to be sent, got %v", denial)
+	}
+	if remaining := denial["seconds_remaining"].(int64); remaining > 30*60 {
+		t.Errorf("delay_mail not applied, %v seconds remaining", remaining)
+	}
+	results := denial["notifications"].([]notifyResult)
+	if len(results) != 2 {
+		t.Fatalf("expected results of 2 channels, got %v", results)
+	}
+	for _, r := range results {
+		if (r.Channel == "broken") == r.Sent {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+
+	sent := testNotifier.take(t.Name() + "-oncall")
+	if len(sent) != 1 || sent[0].Event != eventActivation || sent[0].KeyName != "somebody" ||
+		sent[0].MountPoint != "auth/emerg-yubiotp/" || sent[0].RequestID != denial["request_id"] {
+		t.Errorf("unexpected notifications %+v", sent)
+	}
+	if sent := testNotifier.take(t.Name() + "-security"); len(sent) != 0 {
+		t.Errorf("security channel got %+v", sent)
+	}
+
+	// a replayed OTP only goes to the security channel
+	verifier.add(otp, otpStatusReplayedOTP, 0, 0)
+	if _, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp}); err != logical.ErrPermissionDenied {
+		t.Fatalf("expected denial, got %v", err)
+	}
+	sent = testNotifier.take(t.Name() + "-security")
+	if len(sent) != 1 || sent[0].Security == nil || sent[0].Security.Type != securityEventReplayedOTP {
+		t.Errorf("unexpected security notifications %+v", sent)
+	}
+	if sent := testNotifier.take(t.Name() + "-oncall"); len(sent) != 0 {
+		t.Errorf("oncall channel got %+v", sent)
+	}
+}
+
+func TestKeyEmailRecipients(t *testing.T) {
+	b, s := testBackend(t)
+	ctx := context.Background()
+	// written directly, the config endpoint would connect to the SMTP server
+	entry, _ := logical.StorageEntryJSON("config", &emergencyOTPConfig{
+		SMTPHost: "smtp.invalid",
+		SMTPTo:   "security@example.com, oncall@example.com",
+	})
+	if err := s.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":   testPublicID,
+		"owner_email": "not an address",
+	}); err != nil || !resp.IsError() {
+		t.Errorf("expected invalid owner_email to be rejected, got %v %v", resp, err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":   testPublicID,
+		"recipients":  "Somebody <somebody@example.com>,manager@example.com,Security@example.com",
+		"owner_email": "somebody@example.com",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to write key: %v %v", resp, err)
+	}
+
+	conf, err := b.config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channels, err := b.notifyChannels(ctx, s, conf, &notification{Event: eventActivation, KeyName: "somebody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 2 || channels[0].Name != defaultEmailChannel || channels[1].Name != ownerEmailChannel || !channels[1].owner {
+		t.Fatalf("unexpected channels %+v", channels)
+	}
+	to := channels[0].settings().Get("to").([]string)
+	if strings.Join(to, ",") != "security@example.com,oncall@example.com,manager@example.com" {
+		t.Errorf("unexpected recipients %v", to)
+	}
+	if owner := channels[1].settings().Get("to").([]string); len(owner) != 1 || owner[0] != "somebody@example.com" {
+		t.Errorf("unexpected owner recipients %v", owner)
+	}
+
+	templates, err := parseEmailTemplates(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, text, _, err := templates.render(&notification{Event: eventLogin, KeyName: "somebody", Owner: true}, time.Now())
+	if err != nil || subject != "Your Emergency OTP Key 'somebody' was used to log in to Vault" ||
+		!strings.HasPrefix(text, "This is about your Emergency OTP Key 'somebody'. If you did not use it") {
+		t.Errorf("unexpected owner email %q %q %v", subject, text, err)
+	}
+}
+
+func TestDelayMailNeedsAdminChannel(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if notifySent([]notifyResult{{Channel: ownerEmailChannel, Sent: true}, {Channel: "oncall", Sent: true, EscalationTier: 1}}) {
+		t.Error("the owner email and escalation tiers must not count as notified")
+	}
+
+	// the channel is only reached as a tier of the escalation
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/pager", map[string]interface{}{
+		"type": "memory", "box": t.Name() + "-pager", "events": "security",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "escalation-policy/oncall", map[string]interface{}{
+		"events": "activation", "tier_1": "pager",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create policy: %v %v", resp, err)
+	}
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":  testPublicID,
+		"delay":      60,
+		"delay_mail": 30,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	denial := testDenial(t, resp, err)
+	if sent := testNotifier.take(t.Name() + "-pager"); len(sent) != 1 || sent[0].EscalationTier != 1 {
+		t.Fatalf("expected the escalation tier to be notified, got %+v", sent)
+	}
+	if denial["notification_sent"] == true {
+		t.Errorf("escalation counted as notification: %v", denial)
+	}
+	if remaining := denial["seconds_remaining"].(int64); remaining <= 30*60 {
+		t.Errorf("delay_mail applied, %v seconds remaining", remaining)
+	}
+}
+
+func TestNotifyConcurrently(t *testing.T) {
+	b, s := testBackend(t)
+	for _, name := range []string{"first", "second", "third"} {
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/"+name, map[string]interface{}{
+			"type": "memory", "box": t.Name() + "-" + name, "events": "login", "delay": 1,
+		}); err != nil || resp.IsError() {
+			t.Fatalf("failed to create channel %s: %v %v", name, resp, err)
+		}
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/fourth", map[string]interface{}{
+		"type": "memory", "box": t.Name() + "-fourth", "events": "security", "delay": 1,
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "escalation-policy/oncall", map[string]interface{}{
+		"events": "login", "tier_1": "fourth",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create policy: %v %v", resp, err)
+	}
+
+	start := time.Now()
+	results, err := b.notify(context.Background(), s, &notification{Event: eventLogin, KeyName: "somebody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= 2*time.Second {
+		t.Errorf("channels were sent one after another, took %s", elapsed)
+	}
+	if len(results) != 4 || results[0].Channel != "first" || results[3].Channel != "fourth" || results[3].EscalationTier != 1 {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	for _, r := range results {
+		if !r.Sent {
+			t.Errorf("not sent: %+v", r)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/eternal-flame-AD/yubigo"
+)
+
+// crc16 residue of a valid OTP token including its own checksum
+const otpCRCResidue uint16 = 0xf0b8
+
+var errOTPStoredSecret = errors.New("invalid secret stored on key")
+
+// outcome of comparing the counters of an OTP with the highest ones seen
+const (
+	counterOK = iota
+	// same or lower session use within the same power up
+	counterReplayed
+	// usage counter went backwards, the OTP was generated by another device or long ago
+	counterBackwards
+	// accepted, but the usage counter moved more than allowed for this key
+	counterLeap
+)
+
+// yubiOTPToken is the decrypted 16 byte payload of a Yubico OTP.
+type yubiOTPToken struct {
+	PrivateID  [6]byte
+	Counter    uint16
+	Timestamp  uint32
+	SessionUse uint8
+	Random     uint16
+	CRC        uint16
+}
+
+func otpCRC16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			lsb := crc & 1
+			crc >>= 1
+			if lsb != 0 {
+				crc ^= 0x8408
+			}
+		}
+	}
+	return crc
+}
+
+// splitOTP returns the modhex public ID and the modhex encrypted token of an OTP.
+func splitOTP(otp string) (publicID string, ciphertext string, err error) {
+	return yubigo.ParseOTP(otp)
+}
+
+// decryptOTP decrypts and checksums the token part of an OTP with the given AES-128 key.
+func decryptOTP(ciphertext string, aesKey []byte) (*yubiOTPToken, error) {
+	raw, err := modhexDecode(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != aes.BlockSize {
+		return nil, errors.New("invalid OTP token length")
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, aes.BlockSize)
+	block.Decrypt(plain, raw)
+	if otpCRC16(plain) != otpCRCResidue {
+		return nil, errors.New("OTP checksum mismatch")
+	}
+
+	token := &yubiOTPToken{
+		Counter:    binary.LittleEndian.Uint16(plain[6:8]),
+		Timestamp:  uint32(plain[8]) | uint32(plain[9])<<8 | uint32(plain[10])<<16,
+		SessionUse: plain[11],
+		Random:     binary.LittleEndian.Uint16(plain[12:14]),
+		CRC:        binary.LittleEndian.Uint16(plain[14:16]),
+	}
+	copy(token.PrivateID[:], plain[:6])
+	return token, nil
+}
+
+// verifyOTPLocally checks an OTP against the AES secret and private ID stored on the key.
+// Counters are not checked here, see checkCounters.
+func (k *keyState) verifyOTPLocally(otp string) (*yubiOTPToken, error) {
+	publicID, ciphertext, err := splitOTP(otp)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(publicID, k.PublicID) {
+		return nil, errors.New("public ID mismatch")
+	}
+	aesKey, err := hex.DecodeString(k.AESKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errOTPStoredSecret, err)
+	}
+	privateID, err := hex.DecodeString(k.PrivateID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errOTPStoredSecret, err)
+	}
+
+	token, err := decryptOTP(ciphertext, aesKey)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(token.PrivateID[:], privateID) != 1 {
+		return nil, errors.New("private ID mismatch")
+	}
+	return token, nil
+}
+
+// checkCounters compares the counters of an OTP with the highest pair accepted so far.
+// The stored pair is advanced unless the OTP is to be rejected, the caller is responsible for persisting the key.
+func (k *keyState) checkCounters(counter int64, use int64) int {
+	if counter < k.Counter {
+		return counterBackwards
+	}
+	if counter == k.Counter && use <= k.SessionUse {
+		return counterReplayed
+	}
+
+	result := counterOK
+	// the very first OTP seen has nothing to compare to
+	if k.MaxCounterJump > 0 && (k.Counter > 0 || k.SessionUse > 0) && counter-k.Counter > k.MaxCounterJump {
+		result = counterLeap
+	}
+	k.Counter = counter
+	k.SessionUse = use
+	return result
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+const (
+	testAESKey    = "00112233445566778899aabbccddeeff"
+	testPrivateID = "a1b2c3d4e5f6"
+	testPublicID  = "vvcccccccccc"
+)
+
+func testMakeOTP(t *testing.T, counter uint16, sessionUse uint8) string {
+	t.Helper()
+	plain := make([]byte, 16)
+	privateID, _ := hex.DecodeString(testPrivateID)
+	copy(plain, privateID)
+	binary.LittleEndian.PutUint16(plain[6:8], counter)
+	plain[8], plain[9], plain[10] = 0x12, 0x34, 0x56
+	plain[11] = sessionUse
+	binary.LittleEndian.PutUint16(plain[12:14], 0xbeef)
+	binary.LittleEndian.PutUint16(plain[14:16], ^otpCRC16(plain[:14]))
+
+	key, _ := hex.DecodeString(testAESKey)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Encrypt(plain, plain)
+	return testPublicID + modhexEncode(plain)
+}
+
+func TestDecryptOTP(t *testing.T) {
+	otp := testMakeOTP(t, 5, 3)
+	key, _ := hex.DecodeString(testAESKey)
+	token, err := decryptOTP(otp[12:], key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Counter != 5 || token.SessionUse != 3 || token.Timestamp != 0x563412 {
+		t.Errorf("decryptOTP returned wrong token: %+v", token)
+	}
+
+	wrongKey, _ := hex.DecodeString("ffeeddccbbaa99887766554433221100")
+	if _, err := decryptOTP(otp[12:], wrongKey); err == nil {
+		t.Error("decryptOTP accepted OTP with wrong key")
+	}
+}
+
+func TestVerifyOTPLocally(t *testing.T) {
+	ks := &keyState{
+		PublicID:  testPublicID,
+		AESKey:    testAESKey,
+		PrivateID: testPrivateID,
+	}
+	token, err := ks.verifyOTPLocally(testMakeOTP(t, 5, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Counter != 5 || token.SessionUse != 3 {
+		t.Errorf("wrong counters: %d/%d", token.Counter, token.SessionUse)
+	}
+
+	ks.PrivateID = "000000000000"
+	if _, err := ks.verifyOTPLocally(testMakeOTP(t, 5, 3)); err == nil {
+		t.Error("OTP with wrong private ID was accepted")
+	}
+}
+
+func TestCheckCounters(t *testing.T) {
+	ks := &keyState{MaxCounterJump: 10}
+	if res := ks.checkCounters(5, 3); res != counterOK {
+		t.Errorf("first OTP: got %d", res)
+	}
+	if ks.Counter != 5 || ks.SessionUse != 3 {
+		t.Errorf("counters not advanced: %d/%d", ks.Counter, ks.SessionUse)
+	}
+	if res := ks.checkCounters(5, 3); res != counterReplayed {
+		t.Errorf("replayed OTP: got %d", res)
+	}
+	if res := ks.checkCounters(4, 10); res != counterBackwards {
+		t.Errorf("older OTP: got %d", res)
+	}
+	if res := ks.checkCounters(6, 0); res != counterOK {
+		t.Errorf("next power up: got %d", res)
+	}
+	if res := ks.checkCounters(100, 0); res != counterLeap {
+		t.Errorf("counter leap: got %d", res)
+	}
+	if ks.Counter != 100 {
+		t.Errorf("counters not advanced after leap: %d", ks.Counter)
+	}
+}
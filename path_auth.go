@@ -4,28 +4,25 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 func (b *backend) pathAuthLogin(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	if b.yubiAuth == nil {
-		return logical.ErrorResponse("yubiAuth is not initialized"), logical.ErrPermissionDenied
-	}
-
-	// validate first to prevent bruteforcing
-	yr, ok, err := b.yubiAuth.Verify(strings.TrimSpace(d.Get("otp_response").(string)))
+	otp := strings.TrimSpace(d.Get("otp_response").(string))
+	keyPublicId, _, err := splitOTP(otp)
 	if err != nil {
 		return logical.ErrorResponse("%v", err), logical.ErrPermissionDenied
-	} else if !ok {
+	}
+	if len(keyPublicId) < 12 {
 		return logical.ErrorResponse("yubikey verification failed"), logical.ErrPermissionDenied
 	}
-	sessionUseCounter := yr.GetResultParameter("sessionuse")
-	sessionCounter := yr.GetResultParameter("sessioncounter")
-	keyPublicId := yr.GetResultParameter("otp")[:12]
+	keyPublicId = keyPublicId[:12]
 
 	keyFound := false
 	var key keyState
@@ -37,6 +34,8 @@ func (b *backend) pathAuthLogin(ctx context.Context, req *logical.Request, d *fr
 	}
 	if entry != nil {
 		keyName := string(entry.Value)
+		// held until the counters of this OTP are on file and the login is decided
+		defer b.lockKey(keyName)()
 		entry, err = req.Storage.Get(ctx, "key/"+keyName)
 		if err != nil {
 			return nil, err
@@ -49,13 +48,126 @@ func (b *backend) pathAuthLogin(ctx context.Context, req *logical.Request, d *fr
 		}
 	}
 
+	var verifier otpVerifier
+	if keyFound && key.AESKey != "" {
+		// the key secret is on file, validate offline without calling out
+		verifier = &localVerifier{key: &key}
+	} else if verifier = b.remoteVerifier(); verifier == nil {
+		return logical.ErrorResponse("no OTP verifier is configured"), logical.ErrPermissionDenied
+	}
+
+	// validate first to prevent bruteforcing
+	otpRes, err := verifier.Verify(ctx, otp)
+	if err != nil {
+		return logical.ErrorResponse("%v", err), logical.ErrPermissionDenied
+	} else if !otpRes.OK() {
+		outcome := verifyOutcomeFor(otpRes.Status)
+		if outcome.Counted {
+			b.Logger().Info("yubikey verification failed", "status", otpRes.Status, "public_id", keyPublicId, "server", otpRes.Server)
+			if keyFound {
+				key.countBadOTP(req, time.Now())
+				entry, err = logical.StorageEntryJSON("key/"+key.Name, key)
+				if err != nil {
+					return nil, err
+				}
+				if err := req.Storage.Put(ctx, entry); err != nil {
+					return nil, err
+				}
+			}
+		} else if outcome.Event != "" {
+			ev := newSecurityEvent(req, outcome.Event, outcome.Severity, "validation returned "+otpRes.Status)
+			ev.PublicID = keyPublicId
+			if otpRes.Server != "" {
+				ev.Detail += " from " + otpRes.Server
+			}
+			if keyFound {
+				b.reportSecurityEvent(ctx, req, &key, ev, outcome.Notify)
+				entry, err = logical.StorageEntryJSON("key/"+key.Name, key)
+				if err != nil {
+					return nil, err
+				}
+				if err := req.Storage.Put(ctx, entry); err != nil {
+					return nil, err
+				}
+			} else {
+				// a tampered validation answer is a concern even if the key is not enrolled
+				b.reportSecurityEvent(ctx, req, nil, ev, outcome.Notify && outcome.Event == securityEventBadSignature)
+			}
+		} else {
+			b.Logger().Error("yubikey verification failed", "status", otpRes.Status, "server", otpRes.Server)
+		}
+		return logical.ErrorResponse("yubikey verification failed: %s", outcome.Message), logical.ErrPermissionDenied
+	}
+	sessionCounter := strconv.FormatInt(otpRes.SessionCounter, 10)
+	sessionUseCounter := strconv.FormatInt(otpRes.SessionUse, 10)
+
+	if keyFound {
+		rejected := false
+		if otpRes.CountersKnown {
+			prevCounter, prevUse := key.Counter, key.SessionUse
+			switch key.checkCounters(otpRes.SessionCounter, otpRes.SessionUse) {
+			case counterReplayed:
+				rejected = true
+				b.reportSecurityEvent(ctx, req, &key, newSecurityEvent(req, securityEventReplayedOTP, severityCritical, fmt.Sprintf(
+					"OTP counters %d/%d are not newer than the last seen %d/%d",
+					otpRes.SessionCounter, otpRes.SessionUse, prevCounter, prevUse)), true)
+			case counterBackwards:
+				rejected = true
+				b.reportSecurityEvent(ctx, req, &key, newSecurityEvent(req, securityEventPossibleClone, severityCritical, fmt.Sprintf(
+					"usage counter went backwards from %d to %d",
+					prevCounter, otpRes.SessionCounter)), true)
+			case counterLeap:
+				b.reportSecurityEvent(ctx, req, &key, newSecurityEvent(req, securityEventPossibleClone, severityWarning, fmt.Sprintf(
+					"usage counter jumped from %d to %d",
+					prevCounter, otpRes.SessionCounter)), true)
+			}
+		} else {
+			conf, err := b.config(ctx, req.Storage)
+			if err != nil {
+				return nil, err
+			}
+			if !conf.AllowUnknownCounters {
+				b.Logger().Error("verifier did not report OTP counters, replay check not possible", "key", key.Name, "server", otpRes.Server)
+				return logical.ErrorResponse("yubikey verification failed: the validation server did not report the OTP counters"), logical.ErrPermissionDenied
+			}
+			b.Logger().Warn("verifier did not report OTP counters, replay check skipped", "key", key.Name)
+		}
+
+		// persist the counters right away so this OTP can not be replayed
+		entry, err = logical.StorageEntryJSON("key/"+key.Name, key)
+		if err != nil {
+			return nil, err
+		}
+		if err := req.Storage.Put(ctx, entry); err != nil {
+			return nil, err
+		}
+		if rejected {
+			return logical.ErrorResponse("yubikey verification failed: OTP was used before"), logical.ErrPermissionDenied
+		}
+	}
+
 	// key is not on file
 	if !keyFound {
-		return logical.ErrorResponse("sorry, this key is not allowed"), logical.ErrPermissionDenied
+		ev := newSecurityEvent(req, securityEventUnknownKey, severityInfo, "valid OTP of a key that is not enrolled")
+		ev.PublicID = keyPublicId
+		b.reportSecurityEvent(ctx, req, nil, ev, true)
+		denial := loginDenial{Reason: denyReasonNotEnrolled, Message: "sorry, this key is not allowed"}
+		return denial.response()
 	}
 
 	if key.NextEligibleTime < 0 {
-		return logical.ErrorResponse("sorry, this key is disabled"), logical.ErrPermissionDenied
+		denial := loginDenial{Reason: denyReasonDisabled, Message: "sorry, this key is disabled"}
+		return denial.response()
+	}
+
+	// the key was eligible but the window ran out, back to idle so the waiting period starts over
+	now := time.Now()
+	if key.eligibilityExpired(now) {
+		b.Logger().Info("eligibility of key expired, restarting waiting period", "key", key.Name)
+		key.NextEligibleTime = 0
+		if err := b.endActiveRequest(ctx, req.Storage, &key, requestStateExpired, now); err != nil {
+			return nil, err
+		}
 	}
 
 	keyHumanName := fmt.Sprintf("emergency-key-%s-%s", key.Name, keyPublicId)
@@ -65,54 +177,163 @@ func (b *backend) pathAuthLogin(ctx context.Context, req *logical.Request, d *fr
 	}
 
 	// eligible to login
-	if key.NextEligibleTime > 0 && time.Now().Unix() > key.NextEligibleTime {
-		return &logical.Response{
-			Auth: &logical.Auth{
-				DisplayName: keyHumanName,
-				InternalData: map[string]interface{}{
-					"auth_method":           "emerg-yubiotp",
-					"emerg_yubiotp_keyname": key.Name,
-				},
-				Policies: []string{"default"},
-				EntityID: key.EntityID,
-				Metadata: map[string]string{
-					"session_counter":      sessionCounter,
-					"session_counter_used": sessionUseCounter,
-					"yubikey_public_id":    keyPublicId,
-					"yubikey_entity_id":    key.EntityID,
-					"yubikey_name":         key.Name,
-					"yubikey_alias":        keyAlias,
-				},
-				LeaseOptions: logical.LeaseOptions{
-					TTL:       1 * time.Hour,
-					MaxTTL:    24 * time.Hour,
-					Renewable: true,
-				},
-				Alias: &logical.Alias{
-					Name: keyAlias,
-				},
+	if key.eligible(now) {
+		conf, err := b.config(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		sessionID, err := uuid.GenerateUUID()
+		if err != nil {
+			return nil, err
+		}
+
+		var activation *activationRequest
+		if key.ActiveRequest != "" {
+			if activation, err = getActivationRequest(ctx, req.Storage, key.ActiveRequest); err != nil {
+				return nil, err
+			}
+		}
+		if activation == nil {
+			// armed by an operator without a login before
+			if activation, _, err = newActivationRequest(req, &key, now); err != nil {
+				return nil, err
+			}
+			entry, err = logical.StorageEntryJSON("key/"+key.Name, key)
+			if err != nil {
+				return nil, err
+			}
+			if err := req.Storage.Put(ctx, entry); err != nil {
+				return nil, err
+			}
+		}
+		prevState := activation.State
+		activation.advance(&key, now)
+		if activation.State == requestStateEligible {
+			activation.State = requestStateConsumed
+			activation.ConsumeTime = now.Unix()
+		}
+		if err := b.saveActivationRequest(ctx, req.Storage, activation, prevState, &key); err != nil {
+			return nil, err
+		}
+
+		auth := &logical.Auth{
+			DisplayName: keyHumanName,
+			InternalData: map[string]interface{}{
+				"auth_method":           "emerg-yubiotp",
+				"emerg_yubiotp_keyname": key.Name,
+				// the session cap of renewals counts from here
+				"emerg_yubiotp_eligible_since": strconv.FormatInt(key.NextEligibleTime, 10),
+				"emerg_yubiotp_session_id":     sessionID,
+				"emerg_yubiotp_request_id":     activation.ID,
+			},
+			EntityID: key.EntityID,
+			Metadata: map[string]string{
+				"session_counter":           sessionCounter,
+				"session_counter_used":      sessionUseCounter,
+				"yubikey_public_id":         keyPublicId,
+				"yubikey_entity_id":         key.EntityID,
+				"yubikey_name":              key.Name,
+				"yubikey_alias":             keyAlias,
+				"yubikey_validation_server": otpRes.Server,
+				"yubikey_session_id":        sessionID,
+				"yubikey_request_id":        activation.ID,
+			},
+			Alias: &logical.Alias{
+				Name: keyAlias,
 			},
+		}
+		effectiveTokenParams(&conf.TokenParams, &key).PopulateTokenAuth(auth)
+		if remaining := key.sessionRemaining(key.NextEligibleTime, now); remaining > 0 &&
+			(auth.ExplicitMaxTTL == 0 || auth.ExplicitMaxTTL > remaining) {
+			auth.ExplicitMaxTTL = remaining
+		}
+
+		sess := &keySession{
+			ID:         sessionID,
+			KeyName:    key.Name,
+			Activation: strconv.FormatInt(key.NextEligibleTime, 10),
+			IssueTime:  now.Unix(),
+		}
+		if req.Connection != nil {
+			sess.RemoteAddr = req.Connection.RemoteAddr
+		}
+		if auth.ExplicitMaxTTL > 0 {
+			sess.ExpireTime = now.Add(auth.ExplicitMaxTTL).Unix()
+		} else if auth.Period == 0 && auth.MaxTTL > 0 {
+			sess.ExpireTime = now.Add(auth.MaxTTL).Unix()
+		}
+		sess.TokenExpireTime = now.Add(b.firstTokenTTL(auth)).Unix()
+		if err := putSession(ctx, req.Storage, sess); err != nil {
+			return nil, err
+		}
+
+		// failures are logged, they must not keep the key holder out
+		if _, err := b.notify(ctx, req.Storage, newNotification(req, eventLogin, &key)); err != nil {
+			b.Logger().Error("failed to send login notification", "key", key.Name, "error", err)
+		}
+
+		return &logical.Response{
+			Auth: auth,
 		}, nil
 	}
 
-	nextEligibleUpdated := false
+	var activation *activationRequest
+	if key.ActiveRequest != "" {
+		if activation, err = getActivationRequest(ctx, req.Storage, key.ActiveRequest); err != nil {
+			return nil, err
+		}
+	}
+	// the secret is only known when the request is opened
+	requestSecret := ""
+	if activation == nil || activation.finished() {
+		if activation, requestSecret, err = newActivationRequest(req, &key, now); err != nil {
+			return nil, err
+		}
+	}
+
+	denial := loginDenial{Reason: denyReasonWaiting}
 	returnMsg := ""
 
 	// already waiting for a no-notify approval, try sending a notification again
 	if key.NextEligibleTime == 0 || key.NextEligibleTime > time.Now().Add(time.Duration(key.DelayMail)*time.Minute).Unix() {
-		if sent, err := b.sendNotificationEmail(ctx, req, &key); err != nil {
-			returnMsg += "Email notification failed: " + err.Error() + ". \n"
-		} else if sent {
-			returnMsg += "Email notification sent. \n"
+		n := newNotification(req, eventActivation, &key)
+		// the timer once the notification is out, see below
+		delay := key.DelayMail
+		if key.Delay < delay {
+			delay = key.Delay
+		}
+		n.NextEligibleTime = time.Now().Add(time.Duration(delay) * time.Minute).Unix()
+		results, err := b.notify(ctx, req.Storage, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range results {
+			if r.Sent {
+				returnMsg += "Notification sent via " + r.Channel + ". \n"
+			} else if r.Throttled {
+				returnMsg += "Notification via " + r.Channel + " held back, it was notified recently. \n"
+			} else {
+				returnMsg += "Notification via " + r.Channel + " failed, it will be retried: " + r.Error + ". \n"
+			}
+		}
+		denial.Notifications = results
+		denial.NotificationError = notifyErrors(results)
+		if notifySent(results) {
+			denial.NotificationSent = true
 			key.NextEligibleTime = time.Now().Add(time.Duration(key.DelayMail) * time.Minute).Unix()
-			nextEligibleUpdated = true
+			denial.TimerChanged = true
 		}
 	}
 
 	// for some reason already waiting for a longer time but current configured delay is shorter, update the wait time
 	if key.NextEligibleTime == 0 || key.NextEligibleTime > time.Now().Add(time.Duration(key.Delay)*time.Minute).Unix() {
 		key.NextEligibleTime = time.Now().Add(time.Duration(key.Delay) * time.Minute).Unix()
-		nextEligibleUpdated = true
+		denial.TimerChanged = true
+	}
+
+	activation.advance(&key, now)
+	if err := putActivationRequest(ctx, req.Storage, activation); err != nil {
+		return nil, err
 	}
 
 	entry, err = logical.StorageEntryJSON("key/"+key.Name, key)
@@ -123,21 +344,34 @@ func (b *backend) pathAuthLogin(ctx context.Context, req *logical.Request, d *fr
 		return nil, err
 	}
 
+	returnMsg += "Activation request: " + activation.ID + "\n"
+	if requestSecret != "" {
+		returnMsg += "Status secret: " + requestSecret + "\n"
+	}
+	denial.NextEligibleTime = key.NextEligibleTime
+	denial.RequestID = activation.ID
+	denial.RequestSecret = requestSecret
+
 	if key.NextEligibleTime == 0 {
-		return logical.ErrorResponse(returnMsg + "Unfortunately you could not be authorized at this time."), logical.ErrPermissionDenied
+		if denial.NotificationError != "" {
+			denial.Reason = denyReasonNotificationFailed
+		}
+		denial.Message = returnMsg + "Unfortunately you could not be authorized at this time."
+		return denial.response()
 	}
 
-	if nextEligibleUpdated {
+	if denial.TimerChanged {
 		returnMsg += "Your wait time is updated.\n"
 	} else {
 		returnMsg += "Your wait time is not updated.\n"
 	}
-	return logical.ErrorResponse(
+	denial.Message = fmt.Sprintf(
 		"%sYou need to wait until %v (approx. %d mins) before you could be authorized.",
 		returnMsg,
 		time.Unix(key.NextEligibleTime, 0),
 		(int64)(time.Until(time.Unix(key.NextEligibleTime, 0)).Minutes()),
-	), logical.ErrPermissionDenied
+	)
+	return denial.response()
 }
 
 func (b *backend) pathAuthRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -151,6 +385,7 @@ func (b *backend) pathAuthRenew(ctx context.Context, req *logical.Request, d *fr
 	}
 
 	var ks keyState
+	defer b.lockKey(keyName)()
 	entry, err := req.Storage.Get(ctx, "key/"+keyName)
 	if err != nil {
 		return nil, err
@@ -166,8 +401,53 @@ func (b *backend) pathAuthRenew(ctx context.Context, req *logical.Request, d *fr
 		return logical.ErrorResponse("sorry, this key is disabled"), logical.ErrPermissionDenied
 	}
 
-	if ks.NextEligibleTime > 0 && time.Now().Unix() > ks.NextEligibleTime {
-		return framework.LeaseExtend(30*time.Second, 60*time.Minute, b.System())(ctx, req, d)
+	// the session cap counts from the eligibility the token was issued in, the key may have gone back
+	// to idle since because its eligibility window ran out
+	since := ks.NextEligibleTime
+	if raw, ok := req.Auth.InternalData["emerg_yubiotp_eligible_since"].(string); ok {
+		if since, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	if ks.renewable(since, now) {
+		conf, err := b.config(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		params := effectiveTokenParams(&conf.TokenParams, &ks)
+
+		// learn the accessor of the token so it can be revoked directly later
+		if sessionID, ok := req.Auth.InternalData["emerg_yubiotp_session_id"].(string); ok {
+			sess, err := getSession(ctx, req.Storage, keyName, sessionID)
+			if err != nil {
+				return nil, err
+			}
+			// revoked before its accessor was known
+			if sess == nil || sess.Revoked {
+				return logical.ErrorResponse("sorry, this session was revoked"), logical.ErrPermissionDenied
+			}
+			sess.Accessor = req.Auth.Accessor
+			sess.LastRenewTime = now.Unix()
+			if err := putSession(ctx, req.Storage, sess); err != nil {
+				return nil, err
+			}
+		}
+
+		resp := &logical.Response{Auth: req.Auth}
+		resp.Auth.TTL = params.TokenTTL
+		resp.Auth.MaxTTL = params.TokenMaxTTL
+		resp.Auth.Period = params.TokenPeriod
+		if remaining := ks.sessionRemaining(since, now); remaining > 0 {
+			if resp.Auth.TTL == 0 || resp.Auth.TTL > remaining {
+				resp.Auth.TTL = remaining
+			}
+			if resp.Auth.Period > remaining {
+				resp.Auth.Period = remaining
+			}
+		}
+		return resp, nil
 	}
 
 	return logical.ErrorResponse("sorry, you are not eligible to renew your lease"), logical.ErrPermissionDenied
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func testBackend(t *testing.T) (*backend, logical.Storage) {
+	t.Helper()
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	b := Backend(config)
+	if err := b.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	return b, config.StorageView
+}
+
+func testRequest(b *backend, s logical.Storage, op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation:  op,
+		Path:       path,
+		Data:       data,
+		Storage:    s,
+		MountPoint: "auth/emerg-yubiotp/",
+		Connection: &logical.Connection{RemoteAddr: "192.0.2.1"},
+	})
+}
+
+func testOTP(publicID string, n int) string {
+	return publicID + strings.Repeat(string(moxhexAlphabet[n%16]), 32)
+}
+
+// testDenial checks that a login was denied with a structured response and returns its data.
+func testDenial(t *testing.T, resp *logical.Response, err error) map[string]interface{} {
+	t.Helper()
+	if !errors.Is(err, logical.ErrPermissionDenied) || !resp.IsError() {
+		t.Fatalf("expected denial, got %v %v", resp, err)
+	}
+	data := resp.Data["data"].(map[string]interface{})
+	if resp.Data["error"] != data["message"] {
+		t.Errorf("human message missing from denial %+v", resp.Data)
+	}
+	return data
+}
+
+func TestLoginWaitingThenEligible(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+		"delay":     60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	denial := testDenial(t, resp, err)
+	if denial["reason"] != denyReasonWaiting || denial["timer_changed"] != true || denial["notification_sent"] != false {
+		t.Errorf("unexpected denial %v", denial)
+	}
+	if remaining := denial["seconds_remaining"].(int64); remaining < 3500 || remaining > 3600 {
+		t.Errorf("unexpected seconds remaining %v", remaining)
+	}
+	if _, err := time.Parse(time.RFC3339, denial["next_eligible_time"].(string)); err != nil {
+		t.Errorf("next eligible time is not RFC3339: %v", err)
+	}
+
+	// a second attempt does not move the timer
+	otp = testOTP(testPublicID, 3)
+	verifier.add(otp, otpStatusOK, 1, 3)
+	resp, err = testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if denial := testDenial(t, resp, err); denial["timer_changed"] != false {
+		t.Errorf("unexpected denial %v", denial)
+	}
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"next_eligible_time": "1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp = testOTP(testPublicID, 2)
+	verifier.add(otp, otpStatusOK, 1, 4)
+	resp, err = testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if err != nil || resp == nil || resp.Auth == nil {
+		t.Fatalf("expected login, got %v %v", resp, err)
+	}
+	if resp.Auth.Metadata["yubikey_name"] != "somebody" || resp.Auth.Metadata["session_counter_used"] != "4" {
+		t.Errorf("unexpected metadata %v", resp.Auth.Metadata)
+	}
+}
+
+func TestLoginDenialOverHTTP(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+		"delay":     60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	testDenial(t, resp, err)
+
+	// what the HTTP handler of Vault does with an error response that carries data
+	status, respErr := logical.RespondErrorCommon(&logical.Request{Operation: logical.UpdateOperation}, resp, err)
+	w := httptest.NewRecorder()
+	logical.RespondErrorAndData(w, status, resp.Data["data"], respErr)
+
+	var body struct {
+		Errors []string               `json:"errors"`
+		Data   map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusForbidden || len(body.Errors) != 1 || body.Errors[0] != body.Data["message"] {
+		t.Fatalf("unexpected response %d %+v", w.Code, body)
+	}
+	if body.Data["reason"] != denyReasonWaiting || body.Data["timer_changed"] != true ||
+		body.Data["seconds_remaining"].(float64) < 3500 || body.Data["request_id"] == "" || body.Data["request_secret"] == nil {
+		t.Errorf("unexpected data %v", body.Data)
+	}
+}
+
+func TestLoginRejectsBadOTP(t *testing.T) {
+	b, s := testBackend(t)
+	b.verifier = newMemoryVerifier()
+
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{
+		"otp_response": testOTP(testPublicID, 1),
+	})
+	if err != logical.ErrPermissionDenied || resp == nil || !resp.IsError() {
+		t.Fatalf("expected denial, got %v %v", resp, err)
+	}
+}
+
+func TestLoginCountsBadOTPs(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := testOTP(testPublicID, 1)
+	verifier.add(replayed, otpStatusReplayedOTP, 0, 0)
+	testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": replayed})
+	// invalid OTPs only need the public ID, they must not push the replay out
+	for i := 0; i < maxSecurityEvents+5; i++ {
+		if _, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": testOTP(testPublicID, 2)}); err != logical.ErrPermissionDenied {
+			t.Fatalf("expected denial, got %v", err)
+		}
+	}
+
+	resp, err := testRequest(b, s, logical.ReadOperation, "key/somebody", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := resp.Data["security_events"].([]securityEvent)
+	if len(events) != 1 || events[0].Type != securityEventReplayedOTP {
+		t.Errorf("unexpected security events %+v", events)
+	}
+	if bad := resp.Data["bad_otps"].(badOTPCount); bad.Count != maxSecurityEvents+5 || bad.LastRemoteAddr != "192.0.2.1" {
+		t.Errorf("unexpected bad OTP count %+v", bad)
+	}
+}
+
+func TestLoginDeniedKeys(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if denial := testDenial(t, resp, err); denial["reason"] != denyReasonNotEnrolled {
+		t.Errorf("unexpected denial %v", denial)
+	}
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":          testPublicID,
+		"next_eligible_time": "-1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	otp = testOTP(testPublicID, 2)
+	verifier.add(otp, otpStatusOK, 1, 2)
+	resp, err = testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if denial := testDenial(t, resp, err); denial["reason"] != denyReasonDisabled {
+		t.Errorf("unexpected denial %v", denial)
+	}
+}
+
+func TestLoginHonoursContext(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	verifier.delay = time.Minute
+	b.verifier = verifier
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Data:      map[string]interface{}{"otp_response": testOTP(testPublicID, 1)},
+		Storage:   s,
+	})
+	if err != logical.ErrPermissionDenied {
+		t.Fatalf("expected denial, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("login did not honour the request context")
+	}
+}
+
+func TestLoginRejectsReplayedCounters(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":          testPublicID,
+		"next_eligible_time": "1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 3, 5)
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp}); err != nil || resp.Auth == nil {
+		t.Fatalf("expected login, got %v %v", resp, err)
+	}
+
+	// a validation server that lost its state, or a clone generating an older OTP
+	otp = testOTP(testPublicID, 2)
+	verifier.add(otp, otpStatusOK, 2, 9)
+	if _, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp}); err != logical.ErrPermissionDenied {
+		t.Fatalf("expected denial, got %v", err)
+	}
+
+	resp, err := testRequest(b, s, logical.ReadOperation, "key/somebody", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := resp.Data["security_events"].([]securityEvent)
+	if len(events) != 1 || events[0].Type != securityEventPossibleClone || events[0].RemoteAddr != "192.0.2.1" {
+		t.Errorf("unexpected security events %+v", events)
+	}
+}
+
+// slowStorage widens the window between reading and writing an entry.
+type slowStorage struct {
+	logical.Storage
+}
+
+func (s *slowStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	entry, err := s.Storage.Get(ctx, key)
+	time.Sleep(5 * time.Millisecond)
+	return entry, err
+}
+
+func TestLoginConcurrentReplay(t *testing.T) {
+	b, inmem := testBackend(t)
+	s := &slowStorage{Storage: inmem}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":          testPublicID,
+		"aes_key":            testAESKey,
+		"private_id":         testPrivateID,
+		"next_eligible_time": "1",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to write key: %v %v", resp, err)
+	}
+
+	// validated locally, only the counters on file stop the replays
+	otp := testMakeOTP(t, 1, 1)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	logins := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+			if resp != nil && resp.Auth != nil {
+				mu.Lock()
+				logins++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if logins != 1 {
+		t.Errorf("expected one login with the OTP, got %d", logins)
+	}
+}
+
+func TestKeyLocalSecrets(t *testing.T) {
+	b, s := testBackend(t)
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":  testPublicID,
+		"aes_key":    testAESKey,
+		"private_id": testPrivateID,
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to write key: %v %v", resp, err)
+	}
+	resp, err := testRequest(b, s, logical.ReadOperation, "key/somebody", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["aes_key"] != "********" || resp.Data["private_id"] != "********" {
+		t.Errorf("secrets not masked: %v %v", resp.Data["aes_key"], resp.Data["private_id"])
+	}
+
+	resp, err = testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{"aes_key": ""})
+	if err != nil || !resp.IsError() {
+		t.Errorf("removing only aes_key was accepted: %v %v", resp, err)
+	}
+	resp, err = testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"aes_key":    "",
+		"private_id": "",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("failed to remove secrets: %v %v", resp, err)
+	}
+	ks, err := b.key(context.Background(), s, "somebody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.AESKey != "" || ks.PrivateID != "" {
+		t.Errorf("secrets not removed: %+v", ks)
+	}
+}
+
+func TestLoginRejectsUnknownCounters(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":          testPublicID,
+		"next_eligible_time": "1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 0, 0)
+	verifier.results[otp].CountersKnown = false
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp}); err != logical.ErrPermissionDenied {
+		t.Fatalf("expected denial without counters, got %v %v", resp, err)
+	}
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "config", map[string]interface{}{"allow_unknown_counters": true}); err != nil {
+		t.Fatal(err)
+	}
+	// writing the config rebuilds the verifier
+	b.verifier = verifier
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp}); err != nil || resp.Auth == nil {
+		t.Fatalf("expected login with allow_unknown_counters, got %v %v", resp, err)
+	}
+}
+
+func TestLoginRecordsValidationStatus(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusReplayedOTP, 0, 0)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if err != logical.ErrPermissionDenied || !strings.Contains(resp.Error().Error(), "used before") {
+		t.Fatalf("expected replay denial, got %v %v", resp, err)
+	}
+
+	resp, err = testRequest(b, s, logical.ReadOperation, "key/somebody", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := resp.Data["security_events"].([]securityEvent)
+	if len(events) != 1 || events[0].Type != securityEventReplayedOTP || events[0].Severity != severityCritical || events[0].PublicID != testPublicID {
+		t.Errorf("unexpected security events %+v", events)
+	}
+}
+
+func TestLoginTokenParams(t *testing.T) {
+	b, s := testBackend(t)
+	if _, err := testRequest(b, s, logical.UpdateOperation, "config", map[string]interface{}{
+		"token_policies": "emergency",
+		"token_ttl":      "30m",
+		"token_max_ttl":  "2h",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":          testPublicID,
+		"next_eligible_time": "1",
+		"token_policies":     "emergency,admin",
+		"token_bound_cidrs":  "192.0.2.0/24",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if err != nil || resp.Auth == nil {
+		t.Fatalf("expected login, got %v %v", resp, err)
+	}
+	if strings.Join(resp.Auth.Policies, ",") != "emergency,admin" || resp.Auth.TTL != 30*time.Minute ||
+		resp.Auth.MaxTTL != 2*time.Hour || len(resp.Auth.BoundCIDRs) != 1 {
+		t.Errorf("key token parameters not applied: %+v", resp.Auth)
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RenewOperation,
+		Path:      "login",
+		Storage:   s,
+		Auth:      resp.Auth,
+	})
+	if err != nil || resp.Auth == nil {
+		t.Fatalf("expected renewal, got %v %v", resp, err)
+	}
+	if resp.Auth.TTL != 30*time.Minute || resp.Auth.MaxTTL != 2*time.Hour {
+		t.Errorf("token parameters not applied on renewal: %+v", resp.Auth)
+	}
+}
+
+func TestKeyTokenParamsOverrideZero(t *testing.T) {
+	b, s := testBackend(t)
+	if _, err := testRequest(b, s, logical.UpdateOperation, "config", map[string]interface{}{
+		"token_num_uses":          3,
+		"token_no_default_policy": true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := b.config(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	effective := func(data map[string]interface{}) *tokenutil.TokenParams {
+		t.Helper()
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", data); err != nil || resp.IsError() {
+			t.Fatalf("failed to write key: %v %v", resp, err)
+		}
+		key, err := b.key(context.Background(), s, "somebody")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return effectiveTokenParams(&conf.TokenParams, key)
+	}
+
+	if p := effective(map[string]interface{}{"public_id": testPublicID}); p.TokenNumUses != 3 || !p.TokenNoDefaultPolicy {
+		t.Errorf("mount token parameters not inherited: %+v", p)
+	}
+	if p := effective(map[string]interface{}{"token_num_uses": 0, "token_no_default_policy": false}); p.TokenNumUses != 0 || p.TokenNoDefaultPolicy {
+		t.Errorf("zero values on the key not applied: %+v", p)
+	}
+	if p := effective(map[string]interface{}{"inherit_token_params": "token_num_uses"}); p.TokenNumUses != 3 || p.TokenNoDefaultPolicy {
+		t.Errorf("unexpected parameters after inheriting token_num_uses: %+v", p)
+	}
+}
+
+func TestLoginEligibilityWindowExpires(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+	eligibleSince := time.Now().Add(-2 * time.Minute).Unix()
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":          testPublicID,
+		"delay":              60,
+		"eligibility_window": 1,
+		"next_eligible_time": strconv.FormatInt(eligibleSince, 10),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if denial := testDenial(t, resp, err); denial["reason"] != denyReasonWaiting {
+		t.Fatalf("expected waiting period to restart, got %v", denial)
+	}
+
+	resp, err = testRequest(b, s, logical.ReadOperation, "key/somebody", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := resp.Data["next_eligible_time"].(int64); next < time.Now().Add(59*time.Minute).Unix() {
+		t.Errorf("waiting period not restarted, next eligible time %d", next)
+	}
+
+	// the window is over for new logins only, a token issued within it is still renewed
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RenewOperation,
+		Path:      "login",
+		Storage:   s,
+		Auth: &logical.Auth{InternalData: map[string]interface{}{
+			"emerg_yubiotp_keyname":        "somebody",
+			"emerg_yubiotp_eligible_since": strconv.FormatInt(eligibleSince, 10),
+		}},
+	})
+	if err != nil || resp.Auth == nil {
+		t.Errorf("expected renewal after the window, got %v %v", resp, err)
+	}
+}
+
+func TestLoginSessionCap(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":          testPublicID,
+		"session_cap":        30,
+		"next_eligible_time": strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if err != nil || resp.Auth == nil {
+		t.Fatalf("expected login, got %v %v", resp, err)
+	}
+	if resp.Auth.ExplicitMaxTTL <= 0 || resp.Auth.ExplicitMaxTTL > 20*time.Minute {
+		t.Errorf("session cap not applied, explicit max TTL %v", resp.Auth.ExplicitMaxTTL)
+	}
+}
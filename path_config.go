@@ -4,17 +4,16 @@ import (
 	"context"
 	"strings"
 
-	"github.com/eternal-flame-AD/yubigo"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
-	"gopkg.in/gomail.v2"
 )
 
 const confHelpSynopsis = `Emergency OTP backend.`
 const confHelpDescription = `Emergency OTP backend.`
 
 func (b *backend) pathConfig() *framework.Path {
-	return &framework.Path{
+	p := &framework.Path{
 		Pattern: "config$",
 		Fields: map[string]*framework.FieldSchema{
 			"yubiauth_client_id": {
@@ -28,6 +27,49 @@ func (b *backend) pathConfig() *framework.Path {
 					Sensitive: true,
 				},
 			},
+			"yubiauth_servers": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `YK-VAL validation server URLs, e.g. https://ykval.example.com/wsapi/2.0/verify. YubiCloud is used if empty`,
+			},
+			"yubiauth_ca_bundle": {
+				Type:        framework.TypeString,
+				Description: `PEM encoded CA bundle for the validation servers`,
+			},
+			"yubiauth_proxy": {
+				Type:        framework.TypeString,
+				Description: `HTTP proxy URL for the validation servers`,
+			},
+			"yubiauth_strategy": {
+				Type:        framework.TypeString,
+				Description: `How validation servers are queried: failover (one after another) or parallel`,
+			},
+			"yubiauth_server_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: `Timeout for a single validation server`,
+			},
+			"verify_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: `Timeout for a single OTP validation, defaults to 10s`,
+			},
+			"allow_unknown_counters": {
+				Type:        framework.TypeBool,
+				Description: `Accept OTPs of enrolled keys when the validation server does not report their counters, skipping the replay check. Rejected by default`,
+			},
+			"revocation_vault_addr": {
+				Type:        framework.TypeString,
+				Description: `Vault address used to revoke tokens of disabled keys, VAULT_ADDR of the plugin if empty`,
+			},
+			"revocation_token": {
+				Type:        framework.TypeString,
+				Description: `Token used to revoke tokens of disabled keys, needs update on auth/token/revoke-accessor and, for revoke-sessions, sudo on sys/leases/revoke-prefix/<mount>login`,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Sensitive: true,
+				},
+			},
+			"revocation_ca_bundle": {
+				Type:        framework.TypeString,
+				Description: `PEM encoded CA bundle for revocation_vault_addr`,
+			},
 			"smtp_host": {
 				Type:        framework.TypeString,
 				Description: `SMTP host`,
@@ -55,6 +97,68 @@ func (b *backend) pathConfig() *framework.Path {
 				Type:        framework.TypeString,
 				Description: `SMTP to`,
 			},
+			"smtp_tls_mode": {
+				Type:        framework.TypeString,
+				Description: `implicit (TLS from the start), starttls (required) or none. If empty, TLS is implicit on port 465 and STARTTLS is used when offered on other ports`,
+			},
+			"smtp_ca_bundle": {
+				Type:        framework.TypeString,
+				Description: `PEM encoded CA bundle for the SMTP server`,
+			},
+			"smtp_server_name": {
+				Type:        framework.TypeString,
+				Description: `Name expected in the certificate of the SMTP server, smtp_host if empty`,
+			},
+			"smtp_auth": {
+				Type:        framework.TypeString,
+				Description: `Authentication mechanism: plain, login or cram-md5. Picked from what the server offers if empty, no authentication without smtp_username`,
+			},
+			"smtp_helo": {
+				Type:        framework.TypeString,
+				Description: `Local name sent in HELO/EHLO, localhost if empty`,
+			},
+			"smtp_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: `Timeout for connecting and every SMTP exchange, defaults to 10s`,
+			},
+			"email_subject_template": {
+				Type:        framework.TypeString,
+				Description: `text/template of the email subject, see the README for the variables`,
+			},
+			"email_text_template": {
+				Type:        framework.TypeString,
+				Description: `text/template of the plain text email body`,
+			},
+			"email_html_template": {
+				Type:        framework.TypeString,
+				Description: `html/template of the HTML email body`,
+			},
+			"email_signing_key": {
+				Type:        framework.TypeString,
+				Description: `Armored OpenPGP private key without passphrase, notification emails are signed with it (PGP/MIME)`,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Sensitive: true,
+				},
+			},
+			"dkim_domain": {
+				Type:        framework.TypeString,
+				Description: `Domain of DKIM signatures (d=) of notification emails`,
+			},
+			"dkim_selector": {
+				Type:        framework.TypeString,
+				Description: `Selector of the DKIM key (s=)`,
+			},
+			"dkim_private_key": {
+				Type:        framework.TypeString,
+				Description: `PEM encoded RSA or Ed25519 private key of the DKIM selector`,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Sensitive: true,
+				},
+			},
+			"reminders": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: `Times before a waiting key becomes eligible to send a reminder, e.g. 6h,1h (the default). Empty to send none`,
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.UpdateOperation: &framework.PathOperation{
@@ -71,6 +175,8 @@ func (b *backend) pathConfig() *framework.Path {
 		HelpSynopsis:    confHelpSynopsis,
 		HelpDescription: confHelpDescription,
 	}
+	tokenutil.AddTokenFields(p.Fields)
+	return p
 }
 
 func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -79,18 +185,55 @@ func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, data
 	} else if config == nil {
 		return nil, nil
 	} else {
-		return &logical.Response{
+		resp := &logical.Response{
 			Data: map[string]interface{}{
-				"yubiauth_client_id":  config.YubiAuthClientId,
-				"yubiauth_client_key": strings.Repeat("*", 8),
-				"smtp_host":           config.SMTPHost,
-				"smtp_port":           config.SMTPPort,
-				"smtp_username":       config.SMTPUsername,
-				"smtp_password":       strings.Repeat("*", 8),
-				"smtp_from":           config.SMTPFrom,
-				"smtp_to":             config.SMTPTo,
+				"yubiauth_client_id":      config.YubiAuthClientId,
+				"yubiauth_client_key":     strings.Repeat("*", 8),
+				"yubiauth_servers":        config.YubiAuthServers,
+				"yubiauth_ca_bundle":      config.YubiAuthCABundle,
+				"yubiauth_proxy":          config.YubiAuthProxy,
+				"yubiauth_strategy":       config.YubiAuthStrategy,
+				"yubiauth_server_timeout": config.YubiAuthServerTimeout,
+				"verify_timeout":          config.VerifyTimeout,
+				"allow_unknown_counters":  config.AllowUnknownCounters,
+				"revocation_vault_addr":   config.RevocationVaultAddr,
+				"revocation_token":        strings.Repeat("*", 8),
+				"revocation_ca_bundle":    config.RevocationCABundle,
+				"smtp_host":               config.SMTPHost,
+				"smtp_port":               config.SMTPPort,
+				"smtp_username":           config.SMTPUsername,
+				"smtp_password":           strings.Repeat("*", 8),
+				"smtp_from":               config.SMTPFrom,
+				"smtp_to":                 config.SMTPTo,
+				"smtp_tls_mode":           config.SMTPTLSMode,
+				"smtp_ca_bundle":          config.SMTPCABundle,
+				"smtp_server_name":        config.SMTPServerName,
+				"smtp_auth":               config.SMTPAuth,
+				"smtp_helo":               config.SMTPHelo,
+				"smtp_timeout":            config.SMTPTimeout,
+				"email_subject_template":  config.EmailSubjectTemplate,
+				"email_text_template":     config.EmailTextTemplate,
+				"email_html_template":     config.EmailHTMLTemplate,
+				"email_signing_key":       "",
+				"dkim_domain":             config.DKIMDomain,
+				"dkim_selector":           config.DKIMSelector,
+				"dkim_private_key":        "",
+				"reminders":               config.reminders(),
 			},
-		}, nil
+		}
+		if config.DKIMPrivateKey != "" {
+			resp.Data["dkim_private_key"] = strings.Repeat("*", 8)
+		}
+		if config.EmailSigningKey != "" {
+			resp.Data["email_signing_key"] = strings.Repeat("*", 8)
+			// recipients need the public key to verify signatures
+			if signer, err := readPGPSigningKey(config.EmailSigningKey); err == nil {
+				resp.Data["email_signing_fingerprint"] = pgpFingerprint(signer)
+				resp.Data["email_signing_public_key"], _ = armoredPublicKey(signer)
+			}
+		}
+		config.PopulateTokenData(resp.Data)
+		return resp, nil
 	}
 }
 
@@ -107,6 +250,46 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, dat
 	if ok {
 		config.YubiAuthClientKey = fieldYubiAuthClientKey.(string)
 	}
+	fieldYubiAuthServers, ok := data.GetOk("yubiauth_servers")
+	if ok {
+		config.YubiAuthServers = fieldYubiAuthServers.([]string)
+	}
+	fieldYubiAuthCABundle, ok := data.GetOk("yubiauth_ca_bundle")
+	if ok {
+		config.YubiAuthCABundle = fieldYubiAuthCABundle.(string)
+	}
+	fieldYubiAuthProxy, ok := data.GetOk("yubiauth_proxy")
+	if ok {
+		config.YubiAuthProxy = fieldYubiAuthProxy.(string)
+	}
+	fieldYubiAuthStrategy, ok := data.GetOk("yubiauth_strategy")
+	if ok {
+		config.YubiAuthStrategy = fieldYubiAuthStrategy.(string)
+	}
+	fieldYubiAuthServerTimeout, ok := data.GetOk("yubiauth_server_timeout")
+	if ok {
+		config.YubiAuthServerTimeout = fieldYubiAuthServerTimeout.(int)
+	}
+	fieldVerifyTimeout, ok := data.GetOk("verify_timeout")
+	if ok {
+		config.VerifyTimeout = fieldVerifyTimeout.(int)
+	}
+	fieldAllowUnknownCounters, ok := data.GetOk("allow_unknown_counters")
+	if ok {
+		config.AllowUnknownCounters = fieldAllowUnknownCounters.(bool)
+	}
+	fieldRevocationVaultAddr, ok := data.GetOk("revocation_vault_addr")
+	if ok {
+		config.RevocationVaultAddr = fieldRevocationVaultAddr.(string)
+	}
+	fieldRevocationToken, ok := data.GetOk("revocation_token")
+	if ok {
+		config.RevocationToken = fieldRevocationToken.(string)
+	}
+	fieldRevocationCABundle, ok := data.GetOk("revocation_ca_bundle")
+	if ok {
+		config.RevocationCABundle = fieldRevocationCABundle.(string)
+	}
 	fieldSMTPHost, ok := data.GetOk("smtp_host")
 	if ok {
 		config.SMTPHost = fieldSMTPHost.(string)
@@ -132,19 +315,102 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, dat
 		config.SMTPTo = fieldSMTPTo.(string)
 	}
 
+	fieldSMTPTLSMode, ok := data.GetOk("smtp_tls_mode")
+	if ok {
+		config.SMTPTLSMode = fieldSMTPTLSMode.(string)
+	}
+	fieldSMTPCABundle, ok := data.GetOk("smtp_ca_bundle")
+	if ok {
+		config.SMTPCABundle = fieldSMTPCABundle.(string)
+	}
+	fieldSMTPServerName, ok := data.GetOk("smtp_server_name")
+	if ok {
+		config.SMTPServerName = fieldSMTPServerName.(string)
+	}
+	fieldSMTPAuth, ok := data.GetOk("smtp_auth")
+	if ok {
+		config.SMTPAuth = fieldSMTPAuth.(string)
+	}
+	fieldSMTPHelo, ok := data.GetOk("smtp_helo")
+	if ok {
+		config.SMTPHelo = fieldSMTPHelo.(string)
+	}
+	fieldSMTPTimeout, ok := data.GetOk("smtp_timeout")
+	if ok {
+		config.SMTPTimeout = fieldSMTPTimeout.(int)
+	}
+	fieldEmailSubjectTemplate, ok := data.GetOk("email_subject_template")
+	if ok {
+		config.EmailSubjectTemplate = fieldEmailSubjectTemplate.(string)
+	}
+	fieldEmailTextTemplate, ok := data.GetOk("email_text_template")
+	if ok {
+		config.EmailTextTemplate = fieldEmailTextTemplate.(string)
+	}
+	fieldEmailHTMLTemplate, ok := data.GetOk("email_html_template")
+	if ok {
+		config.EmailHTMLTemplate = fieldEmailHTMLTemplate.(string)
+	}
+
+	fieldEmailSigningKey, ok := data.GetOk("email_signing_key")
+	if ok {
+		config.EmailSigningKey = fieldEmailSigningKey.(string)
+	}
+
+	fieldDKIMDomain, ok := data.GetOk("dkim_domain")
+	if ok {
+		config.DKIMDomain = fieldDKIMDomain.(string)
+	}
+	fieldDKIMSelector, ok := data.GetOk("dkim_selector")
+	if ok {
+		config.DKIMSelector = fieldDKIMSelector.(string)
+	}
+	fieldDKIMPrivateKey, ok := data.GetOk("dkim_private_key")
+	if ok {
+		config.DKIMPrivateKey = fieldDKIMPrivateKey.(string)
+	}
+
+	fieldReminders, ok := data.GetOk("reminders")
+	if ok {
+		reminders, err := parseReminders(fieldReminders.([]string))
+		if err != nil {
+			return logical.ErrorResponse("reminders not valid: %v", err), nil
+		}
+		config.Reminders = reminders
+	}
+
+	if err := config.ParseTokenFields(req, data); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	if err := validateEmailTemplates(config); err != nil {
+		return logical.ErrorResponse("email template not valid: %v", err), nil
+	}
+
+	if config.EmailSigningKey != "" {
+		if _, err := readPGPSigningKey(config.EmailSigningKey); err != nil {
+			return logical.ErrorResponse("email_signing_key not valid: %v", err), nil
+		}
+	}
+
+	if config.DKIMDomain != "" || config.DKIMSelector != "" || config.DKIMPrivateKey != "" {
+		if _, err := newDKIMSigner(config); err != nil {
+			return logical.ErrorResponse("DKIM config not valid: %v", err), nil
+		}
+	}
+
 	if config.SMTPHost != "" {
-		d, err := gomail.NewDialer(config.SMTPHost, config.SMTPPort, config.SMTPUsername, config.SMTPPassword).Dial()
-		if d != nil {
-			defer d.Close()
+		transport, err := newSMTPTransport(config)
+		if err == nil {
+			err = transport.check()
 		}
 		if err != nil {
 			return logical.ErrorResponse("SMTP config not valid: %v", err), nil
 		}
 	}
 
-	b.yubiAuth, err = yubigo.NewYubiAuth(config.YubiAuthClientId, config.YubiAuthClientKey)
-	if err != nil {
-		return nil, err
+	if err := b.resetVerifier(config); err != nil {
+		return logical.ErrorResponse("YubiAuth config not valid: %v", err), nil
 	}
 
 	entry, err := logical.StorageEntryJSON("config", config)
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// events an escalation policy can start on, the ones caused by login attempts
+var escalationEvents = throttledEvents
+
+// number of tiers of an escalation policy
+const escalationTiers = 3
+
+// wait before a tier if the policy does not set one
+const defaultEscalationWait = 15 * time.Minute
+
+// finished escalations are kept this long
+const escalationRetention = 7 * 24 * time.Hour
+
+const (
+	escalationOpen         = "open"
+	escalationAcknowledged = "acknowledged"
+	// every tier was notified without an acknowledgement
+	escalationExhausted = "exhausted"
+	// the activation ended or the policy was removed before anybody acknowledged
+	escalationResolved = "resolved"
+)
+
+// escalationPolicy notifies its tiers one after another until somebody acknowledges.
+type escalationPolicy struct {
+	Name   string   `json:"name"`
+	Events []string `json:"events"`
+	// channel names of each tier, tier 1 first
+	Tiers [][]string `json:"tiers"`
+	// seconds to wait for an acknowledgement before each tier, the first is 0
+	Waits []int64 `json:"waits"`
+}
+
+func (p *escalationPolicy) subscribed(event string) bool {
+	return strutil.StrListContains(p.Events, event)
+}
+
+// escalation is a notification going through the tiers of a policy.
+type escalation struct {
+	ID     string `json:"id"`
+	Policy string `json:"policy"`
+	// notifications of the same group share an escalation, see escalationGroup
+	Group        string        `json:"group"`
+	State        string        `json:"state"`
+	Notification *notification `json:"notification"`
+	// number of tiers notified so far
+	Tier int `json:"tier"`
+	// channels that got the notification, on their own events or from a tier, are not sent it again
+	Notified   []string `json:"notified"`
+	CreateTime int64    `json:"create_time"`
+	// when the next tier is due, 0 if there is none
+	NextTime int64  `json:"next_time"`
+	AckTime  int64  `json:"ack_time"`
+	AckBy    string `json:"ack_by"`
+	EndTime  int64  `json:"end_time"`
+}
+
+func (e *escalation) waiting() bool {
+	return e.State == escalationOpen || e.State == escalationExhausted
+}
+
+// escalationGroup names what repeated notifications escalate once: an activation, the logins of one
+// activation or the security events of a key.
+func escalationGroup(n *notification) string {
+	key := n.KeyName
+	if key == "" {
+		key = "public-id:" + n.PublicID
+	}
+	if n.Event == eventSecurity {
+		return n.Event + "/" + key
+	}
+	return n.Event + "/" + key + "/" + n.RequestID
+}
+
+func getEscalationPolicy(ctx context.Context, s logical.Storage, name string) (*escalationPolicy, error) {
+	entry, err := s.Get(ctx, "escalation-policy/"+name)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var p escalationPolicy
+	if err := entry.DecodeJSON(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func getEscalation(ctx context.Context, s logical.Storage, id string) (*escalation, error) {
+	entry, err := s.Get(ctx, "escalation/"+id)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var e escalation
+	if err := entry.DecodeJSON(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func putEscalation(ctx context.Context, s logical.Storage, e *escalation) error {
+	entry, err := logical.StorageEntryJSON("escalation/"+e.ID, e)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func listEscalations(ctx context.Context, s logical.Storage) ([]*escalation, error) {
+	ids, err := s.List(ctx, "escalation/")
+	if err != nil {
+		return nil, err
+	}
+	escalations := make([]*escalation, 0, len(ids))
+	for _, id := range ids {
+		e, err := getEscalation(ctx, s, id)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			escalations = append(escalations, e)
+		}
+	}
+	return escalations, nil
+}
+
+// reachable returns the channel as it can be used now: nil in its quiet hours, email channels without the
+// recipients in their quiet hours.
+func (b *backend) reachable(ctx context.Context, s logical.Storage, c *notifyChannel, now time.Time) (*notifyChannel, error) {
+	if isQuiet(c.QuietHours, c.TimeZone, now) {
+		return nil, nil
+	}
+	if c.Type != "email" {
+		return c, nil
+	}
+	var to []string
+	for _, address := range c.settings().Get("to").([]string) {
+		r, err := getEmailRecipient(ctx, s, address)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil || !isQuiet(r.QuietHours, r.TimeZone, now) {
+			to = append(to, address)
+		}
+	}
+	if len(to) == 0 {
+		return nil, nil
+	}
+	reduced := *c
+	reduced.Settings = make(map[string]interface{}, len(c.Settings))
+	for k, v := range c.Settings {
+		reduced.Settings[k] = v
+	}
+	reduced.Settings["to"] = to
+	return &reduced, nil
+}
+
+// reachableTier is reachable for a channel notified by a tier of an escalation. The last tier of the
+// policy was notified regardless of quiet hours, so is its channel.
+func (b *backend) reachableTier(ctx context.Context, s logical.Storage, c *notifyChannel, n *notification, now time.Time) (*notifyChannel, error) {
+	rc, err := b.reachable(ctx, s, c, now)
+	if err != nil || rc != nil {
+		return rc, err
+	}
+	e, err := getEscalation(ctx, s, n.EscalationID)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	p, err := getEscalationPolicy(ctx, s, e.Policy)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	if n.EscalationTier >= len(p.Tiers) {
+		return c, nil
+	}
+	return nil, nil
+}
+
+// escalate notifies the next tier of the policy, leaving out channels that already got the notification
+// and applying their throttles. A tier with nobody outside their quiet hours is passed over, the next one
+// still waits for its time. The last tier is notified regardless.
+func (b *backend) escalate(ctx context.Context, s logical.Storage, conf *emergencyOTPConfig, p *escalationPolicy, e *escalation, now time.Time) ([]notifyResult, error) {
+	all, err := b.notifyChannels(ctx, s, conf, e.Notification)
+	if err != nil {
+		return nil, err
+	}
+	channels := make(map[string]*notifyChannel, len(all))
+	for _, c := range all {
+		channels[c.Name] = c
+	}
+
+	var results []notifyResult
+	if e.Tier < len(p.Tiers) {
+		tier := p.Tiers[e.Tier]
+		e.Tier++
+		var reached []*notifyChannel
+		for _, name := range tier {
+			c := channels[name]
+			if c == nil {
+				b.Logger().Warn("escalation channel does not exist", "policy", p.Name, "channel", name)
+				continue
+			}
+			rc, err := b.reachable(ctx, s, c, now)
+			if err != nil {
+				return results, err
+			}
+			if rc != nil {
+				reached = append(reached, rc)
+			}
+		}
+		if len(reached) == 0 && e.Tier == len(p.Tiers) {
+			for _, name := range tier {
+				if c := channels[name]; c != nil {
+					reached = append(reached, c)
+				}
+			}
+		}
+		if len(reached) == 0 {
+			b.Logger().Info("skipping escalation tier, nobody is reachable", "escalation", e.ID, "tier", e.Tier)
+		}
+		var sends []*outgoing
+		for _, c := range reached {
+			if strutil.StrListContains(e.Notified, c.Name) {
+				continue
+			}
+			e.Notified = append(e.Notified, c.Name)
+			n := *e.Notification
+			n.Owner = c.owner
+			n.EscalationID = e.ID
+			n.EscalationTier = e.Tier
+			throttled, err := b.throttle(ctx, s, conf, c, &n, now)
+			if err != nil {
+				return results, err
+			}
+			o := &outgoing{channel: c, n: &n}
+			if throttled {
+				o.result = notifyResult{Channel: c.Name, Type: c.Type, Throttled: true}
+			}
+			sends = append(sends, o)
+		}
+		err := b.sendAll(ctx, s, conf, sends, now)
+		for _, o := range sends {
+			o.result.EscalationTier = e.Tier
+			results = append(results, o.result)
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+
+	if e.Tier >= len(p.Tiers) {
+		e.State = escalationExhausted
+		e.NextTime = 0
+		e.EndTime = now.Unix()
+	} else {
+		e.NextTime = now.Unix() + p.Waits[e.Tier]
+	}
+	return results, nil
+}
+
+// startEscalations notifies the first tier of the policies subscribed to n, unless the same
+// activation or key is escalating already. notified names the channels n was sent to already.
+func (b *backend) startEscalations(ctx context.Context, s logical.Storage, conf *emergencyOTPConfig, n *notification, notified []string, now time.Time) ([]notifyResult, error) {
+	names, err := s.List(ctx, "escalation-policy/")
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	escalations, err := listEscalations(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	group := escalationGroup(n)
+
+	var results []notifyResult
+	for _, name := range names {
+		p, err := getEscalationPolicy(ctx, s, name)
+		if err != nil {
+			return results, err
+		}
+		if p == nil || !p.subscribed(n.Event) {
+			continue
+		}
+		running := false
+		for _, e := range escalations {
+			// an activation escalates once, new security events start over once nobody answered the last tier
+			if e.Policy == p.Name && e.Group == group && (e.State == escalationOpen || e.State == escalationExhausted && n.Event != eventSecurity) {
+				running = true
+				break
+			}
+		}
+		if running {
+			continue
+		}
+
+		id, err := uuid.GenerateUUID()
+		if err != nil {
+			return results, err
+		}
+		e := &escalation{
+			ID:           id,
+			Policy:       p.Name,
+			Group:        group,
+			State:        escalationOpen,
+			Notification: n,
+			Notified:     append([]string(nil), notified...),
+			CreateTime:   now.Unix(),
+		}
+		tierResults, err := b.escalate(ctx, s, conf, p, e, now)
+		results = append(results, tierResults...)
+		if err != nil {
+			return results, err
+		}
+		if err := putEscalation(ctx, s, e); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// escalateDue notifies the next tier of escalations nobody acknowledged in time and forgets old finished ones.
+func (b *backend) escalateDue(ctx context.Context, s logical.Storage, now time.Time) error {
+	escalations, err := listEscalations(ctx, s)
+	if err != nil {
+		return err
+	}
+	var conf *emergencyOTPConfig
+	for _, e := range escalations {
+		if e.State != escalationOpen {
+			if e.EndTime > 0 && time.Unix(e.EndTime, 0).Add(escalationRetention).Before(now) {
+				if err := s.Delete(ctx, "escalation/"+e.ID); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// nobody needs to be woken up for an activation that is over
+		if e.Notification.Event == eventActivation && e.Notification.RequestID != "" {
+			r, err := getActivationRequest(ctx, s, e.Notification.RequestID)
+			if err != nil {
+				return err
+			}
+			if r == nil || r.finished() {
+				e.State = escalationResolved
+				e.EndTime = now.Unix()
+				if err := putEscalation(ctx, s, e); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if e.NextTime > now.Unix() {
+			continue
+		}
+
+		p, err := getEscalationPolicy(ctx, s, e.Policy)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			e.State = escalationResolved
+			e.EndTime = now.Unix()
+		} else {
+			if conf == nil {
+				if conf, err = b.config(ctx, s); err != nil {
+					return err
+				}
+			}
+			if _, err := b.escalate(ctx, s, conf, p, e, now); err != nil {
+				return err
+			}
+		}
+		if err := putEscalation(ctx, s, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tierField(i int) string {
+	return fmt.Sprintf("tier_%d", i+1)
+}
+
+func tierWaitField(i int) string {
+	return fmt.Sprintf("tier_%d_after", i+1)
+}
+
+func (b *backend) pathEscalations() []*framework.Path {
+	policyFields := map[string]*framework.FieldSchema{
+		"name": {
+			Type:        framework.TypeString,
+			Description: "Name of the escalation policy",
+		},
+		"events": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Events that start an escalation: " + strings.Join(escalationEvents, ", ") + ". Defaults to activation",
+		},
+	}
+	for i := 0; i < escalationTiers; i++ {
+		policyFields[tierField(i)] = &framework.FieldSchema{
+			Type:        framework.TypeCommaStringSlice,
+			Description: fmt.Sprintf("Channels of tier %d", i+1),
+		}
+		if i > 0 {
+			policyFields[tierWaitField(i)] = &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("How long to wait for an acknowledgement before tier %d is notified, defaults to 15m", i+1),
+			}
+		}
+	}
+
+	return []*framework.Path{
+		{
+			Pattern: `escalation-policy/(?P<name>[\w.-]+)$`,
+			Fields:  policyFields,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathEscalationPolicyWrite,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathEscalationPolicyWrite,
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathEscalationPolicyRead,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathEscalationPolicyDelete,
+				},
+			},
+			HelpSynopsis: "Manage escalation policies",
+		},
+		{
+			Pattern: `escalation-policy/?$`,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathEscalationPolicyList,
+				},
+			},
+			HelpSynopsis: "List escalation policies",
+		},
+		{
+			Pattern: `escalation/(?P<id>[^/]+)/ack$`,
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "ID of the escalation",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathEscalationAck,
+				},
+			},
+			HelpSynopsis: "Acknowledge an escalation, no further tiers are notified",
+		},
+		{
+			Pattern: `escalation/(?P<id>[^/]+)$`,
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "ID of the escalation",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathEscalationRead,
+				},
+			},
+			HelpSynopsis: "Read the state of an escalation",
+		},
+		{
+			Pattern: `escalation/?$`,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathEscalationList,
+				},
+			},
+			HelpSynopsis: "List escalations",
+		},
+	}
+}
+
+func (b *backend) pathEscalationPolicyWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	p, err := getEscalationPolicy(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		p = &escalationPolicy{Name: name, Events: []string{eventActivation}}
+	}
+
+	events, ok := data.GetOk("events")
+	if ok {
+		p.Events = events.([]string)
+	}
+	if len(p.Events) == 0 {
+		return logical.ErrorResponse("events must not be empty"), nil
+	}
+	for _, e := range p.Events {
+		if !strutil.StrListContains(escalationEvents, e) {
+			return logical.ErrorResponse("invalid event %q, must be one of %s", e, strings.Join(escalationEvents, ", ")), nil
+		}
+	}
+
+	tiers := make([][]string, escalationTiers)
+	waits := make([]int64, escalationTiers)
+	for i := 0; i < escalationTiers; i++ {
+		if i < len(p.Tiers) {
+			tiers[i], waits[i] = p.Tiers[i], p.Waits[i]
+		} else if i > 0 {
+			waits[i] = int64(defaultEscalationWait / time.Second)
+		}
+		if v, ok := data.GetOk(tierField(i)); ok {
+			tiers[i] = v.([]string)
+		}
+		if i > 0 {
+			if v, ok := data.GetOk(tierWaitField(i)); ok {
+				waits[i] = int64(v.(int))
+			}
+			if waits[i] < 0 {
+				return logical.ErrorResponse("%s must not be negative", tierWaitField(i)), nil
+			}
+		}
+	}
+	// tiers are used up to the first empty one
+	p.Tiers, p.Waits = nil, nil
+	for i := 0; i < escalationTiers && len(tiers[i]) > 0; i++ {
+		p.Tiers = append(p.Tiers, tiers[i])
+		p.Waits = append(p.Waits, waits[i])
+	}
+	for i := len(p.Tiers); i < escalationTiers; i++ {
+		if len(tiers[i]) > 0 {
+			return logical.ErrorResponse("%s is set but %s is empty", tierField(i), tierField(len(p.Tiers))), nil
+		}
+	}
+	if len(p.Tiers) == 0 {
+		return logical.ErrorResponse("tier_1 must not be empty"), nil
+	}
+
+	for _, tier := range p.Tiers {
+		for _, channel := range tier {
+			if channel == defaultEmailChannel || channel == ownerEmailChannel {
+				continue
+			}
+			c, err := getNotifyChannel(ctx, req.Storage, channel)
+			if err != nil {
+				return nil, err
+			}
+			if c == nil {
+				return logical.ErrorResponse("could not find channel named %s", channel), nil
+			}
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON("escalation-policy/"+name, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *backend) pathEscalationPolicyRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	p, err := getEscalationPolicy(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("could not find escalation policy named %s", name), nil
+	}
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name":   p.Name,
+			"events": p.Events,
+		},
+	}
+	for i := 0; i < escalationTiers; i++ {
+		resp.Data[tierField(i)] = []string{}
+		if i < len(p.Tiers) {
+			resp.Data[tierField(i)] = p.Tiers[i]
+			if i > 0 {
+				resp.Data[tierWaitField(i)] = p.Waits[i]
+			}
+		}
+	}
+	return resp, nil
+}
+
+func (b *backend) pathEscalationPolicyDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, "escalation-policy/"+data.Get("name").(string)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *backend) pathEscalationPolicyList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, "escalation-policy/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(names), nil
+}
+
+func (e *escalation) statusData() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          e.ID,
+		"policy":      e.Policy,
+		"state":       e.State,
+		"event":       e.Notification.Event,
+		"key":         e.Notification.KeyName,
+		"request_id":  e.Notification.RequestID,
+		"tier":        e.Tier,
+		"create_time": e.CreateTime,
+		"next_time":   e.NextTime,
+		"ack_time":    e.AckTime,
+		"ack_by":      e.AckBy,
+		"end_time":    e.EndTime,
+	}
+}
+
+func (b *backend) pathEscalationRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	e, err := getEscalation(ctx, req.Storage, data.Get("id").(string))
+	if err != nil || e == nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: e.statusData(),
+	}, nil
+}
+
+func (b *backend) pathEscalationList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	ids, err := req.Storage.List(ctx, "escalation/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(ids), nil
+}
+
+func (b *backend) pathEscalationAck(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	id := data.Get("id").(string)
+	e, err := getEscalation(ctx, req.Storage, id)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return logical.ErrorResponse("could not find escalation %s", id), nil
+	}
+	if !e.waiting() {
+		return logical.ErrorResponse("escalation %s is %s already", id, e.State), nil
+	}
+	now := time.Now()
+	e.State = escalationAcknowledged
+	e.AckTime = now.Unix()
+	e.AckBy = req.DisplayName
+	if e.AckBy == "" {
+		e.AckBy = req.EntityID
+	}
+	e.NextTime = 0
+	e.EndTime = now.Unix()
+	if err := putEscalation(ctx, req.Storage, e); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("escalation acknowledged", "escalation", e.ID, "policy", e.Policy, "key", e.Notification.KeyName, "by", e.AckBy)
+	return &logical.Response{
+		Data: e.statusData(),
+	}, nil
+}
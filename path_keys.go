@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"net/mail"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -16,13 +21,100 @@ type keyState struct {
 	PublicID         string `json:"public_id"`
 	EntityID         string `json:"entity_id"`
 	NextEligibleTime int64  `json:"next_eligible_time"`
+	// ID of the open activation request, empty while idle
+	ActiveRequest string `json:"active_request"`
 
 	Delay     int64 `json:"delay"`
 	DelayMail int64 `json:"delay_mail"`
+	// minutes after NextEligibleTime the key returns to idle, 0 to stay eligible until reset
+	EligibilityWindow int64 `json:"eligibility_window"`
+	// minutes after NextEligibleTime no token of the key may live past, 0 for no cap
+	SessionCap int64 `json:"session_cap"`
+
+	// offline validation, hex encoded
+	AESKey     string `json:"aes_key"`
+	PrivateID  string `json:"private_id"`
+	Counter    int64  `json:"counter"`
+	SessionUse int64  `json:"session_use"`
+
+	// flag a possible clone if the usage counter moves more than this, 0 to disable
+	MaxCounterJump int64           `json:"max_counter_jump"`
+	SecurityEvents []securityEvent `json:"security_events"`
+	BadOTPs        badOTPCount     `json:"bad_otps"`
+
+	// email recipients of the key on top of smtp_to
+	Recipients []string `json:"recipients"`
+	// holder of the key, told when it is used
+	OwnerEmail string `json:"owner_email"`
+
+	// overrides the token parameters of the mount
+	tokenutil.TokenParams
+	// token_* fields set on the key, nil for keys written before they were tracked, see tokenOverrides
+	TokenOverrides []string `json:"token_overrides"`
+}
+
+// lockKey locks the state of the key until the returned function is called. Handlers that write the key
+// hold it from reading the key on, so e.g. two logins with the same OTP can not both pass the counter check.
+func (b *backend) lockKey(name string) func() {
+	lock := locksutil.LockForKey(b.keyLocks, name)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// key loads a key, nil if there is no key with that name.
+func (b *backend) key(ctx context.Context, s logical.Storage, name string) (*keyState, error) {
+	entry, err := s.Get(ctx, "key/"+name)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var ks keyState
+	if err := entry.DecodeJSON(&ks); err != nil {
+		return nil, err
+	}
+	return &ks, nil
+}
+
+// eligible tells whether the key may log in: the waiting period is over and neither the
+// eligibility window nor the session cap has run out yet. Tokens already issued are renewed
+// regardless of the window, see renewable.
+func (k *keyState) eligible(now time.Time) bool {
+	return k.NextEligibleTime > 0 && now.Unix() > k.NextEligibleTime && !k.eligibilityExpired(now)
+}
+
+// eligibilityExpired tells whether the key was eligible but the eligibility window or the session cap ran out.
+func (k *keyState) eligibilityExpired(now time.Time) bool {
+	if k.NextEligibleTime <= 0 {
+		return false
+	}
+	if k.EligibilityWindow > 0 && now.Unix() >= k.NextEligibleTime+k.EligibilityWindow*60 {
+		return true
+	}
+	if k.SessionCap > 0 && now.Unix() >= k.NextEligibleTime+k.SessionCap*60 {
+		return true
+	}
+	return false
+}
+
+// renewable tells whether a token issued while the key was eligible since the given time may be renewed,
+// only the session cap ends it.
+func (k *keyState) renewable(since int64, now time.Time) bool {
+	if since <= 0 || now.Unix() <= since {
+		return false
+	}
+	return k.SessionCap <= 0 || now.Unix() < since+k.SessionCap*60
+}
+
+// sessionRemaining is how long a token issued while the key was eligible since the given time may still
+// live under the session cap, 0 if there is no cap.
+func (k *keyState) sessionRemaining(since int64, now time.Time) time.Duration {
+	if k.SessionCap <= 0 || since <= 0 {
+		return 0
+	}
+	return time.Unix(since+k.SessionCap*60, 0).Sub(now)
 }
 
 func (b *backend) pathKeys() []*framework.Path {
-	return []*framework.Path{
+	paths := []*framework.Path{
 		{
 			Pattern: `key/(?P<name>.+)`,
 			Fields: map[string]*framework.FieldSchema{
@@ -54,6 +146,48 @@ func (b *backend) pathKeys() []*framework.Path {
 					Type:        framework.TypeString,
 					Description: "The next time the key is eligible to be used. unix timestamp or +10m",
 				},
+				"eligibility_window": {
+					Type:        framework.TypeInt,
+					Description: "Minutes the key stays eligible before returning to idle and restarting the delay on the next login, 0 to stay eligible until reset",
+				},
+				"session_cap": {
+					Type:        framework.TypeInt,
+					Description: "Minutes after the key became eligible that no token of the key may outlive, 0 for no cap",
+				},
+				"aes_key": {
+					Type:        framework.TypeString,
+					Description: "AES-128 secret of the key in hex, enables offline validation without YubiCloud, empty together with private_id to remove it",
+					DisplayAttrs: &framework.DisplayAttributes{
+						Sensitive: true,
+					},
+				},
+				"private_id": {
+					Type:        framework.TypeString,
+					Description: "Private ID of the key in hex, required with aes_key",
+					DisplayAttrs: &framework.DisplayAttributes{
+						Sensitive: true,
+					},
+				},
+				"max_counter_jump": {
+					Type:        framework.TypeInt,
+					Description: "Flag a possible clone if the usage counter of the key increases by more than this between two logins, 0 to disable",
+				},
+				"recipients": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Email addresses notified about the key, on top of smtp_to of the mount",
+				},
+				"owner_email": {
+					Type:        framework.TypeString,
+					Description: "Email address of the key holder, who gets a message of their own when the key is used",
+				},
+				"inherit_token_params": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Token parameters to take from the mount again, e.g. token_ttl,token_policies",
+				},
+				"reset_counters": {
+					Type:        framework.TypeBool,
+					Description: "Forget the highest OTP counters seen, needed after the key slot was reprogrammed",
+				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
 				logical.UpdateOperation: &framework.PathOperation{
@@ -79,6 +213,8 @@ func (b *backend) pathKeys() []*framework.Path {
 			HelpSynopsis: "List all keys",
 		},
 	}
+	tokenutil.AddTokenFields(paths[0].Fields)
+	return paths
 }
 
 func (b *backend) pathKeyWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -89,6 +225,7 @@ func (b *backend) pathKeyWrite(ctx context.Context, req *logical.Request, data *
 	ks.Delay = -1
 	ks.DelayMail = -1
 
+	defer b.lockKey(name)()
 	entry, err := req.Storage.Get(ctx, "key/"+name)
 	if err != nil {
 		return nil, err
@@ -127,6 +264,84 @@ func (b *backend) pathKeyWrite(ctx context.Context, req *logical.Request, data *
 	if ok {
 		ks.DelayMail = int64(delaymail.(int))
 	}
+	eligibilityWindow, ok := data.GetOk("eligibility_window")
+	if ok {
+		ks.EligibilityWindow = int64(eligibilityWindow.(int))
+	}
+	sessionCap, ok := data.GetOk("session_cap")
+	if ok {
+		ks.SessionCap = int64(sessionCap.(int))
+	}
+	if ks.EligibilityWindow < 0 || ks.SessionCap < 0 {
+		return logical.ErrorResponse("eligibility_window and session_cap can not be negative"), nil
+	}
+
+	// an empty value removes the secret, the key goes back to YubiCloud
+	aesKey, ok := data.GetOk("aes_key")
+	if ok {
+		v := strings.TrimSpace(aesKey.(string))
+		if d, err := hex.DecodeString(v); v != "" && (err != nil || len(d) != 16) {
+			return logical.ErrorResponse("invalid aes_key: must be 16 bytes in hex"), nil
+		}
+		ks.AESKey = strings.ToLower(v)
+	}
+	privateID, ok := data.GetOk("private_id")
+	if ok {
+		v := strings.TrimSpace(privateID.(string))
+		if d, err := hex.DecodeString(v); v != "" && (err != nil || len(d) != 6) {
+			return logical.ErrorResponse("invalid private_id: must be 6 bytes in hex"), nil
+		}
+		ks.PrivateID = strings.ToLower(v)
+	}
+	if (ks.AESKey == "") != (ks.PrivateID == "") {
+		return logical.ErrorResponse("aes_key and private_id must be set together"), nil
+	}
+
+	maxCounterJump, ok := data.GetOk("max_counter_jump")
+	if ok {
+		ks.MaxCounterJump = int64(maxCounterJump.(int))
+	}
+	recipients, ok := data.GetOk("recipients")
+	if ok {
+		ks.Recipients = recipients.([]string)
+	}
+	ownerEmail, ok := data.GetOk("owner_email")
+	if ok {
+		ks.OwnerEmail = strings.TrimSpace(ownerEmail.(string))
+	}
+	for _, r := range append([]string{ks.OwnerEmail}, ks.Recipients...) {
+		if _, err := mail.ParseAddress(r); r != "" && err != nil {
+			return logical.ErrorResponse("invalid email address %q", r), nil
+		}
+	}
+
+	if data.Get("reset_counters").(bool) {
+		ks.Counter = 0
+		ks.SessionUse = 0
+	}
+
+	if err := ks.ParseTokenFields(req, data); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	// remember what was set on the key, so 0 and false override the mount as well
+	overrides := ks.tokenOverrides()
+	for _, field := range tokenParamFields {
+		if _, ok := data.GetOk(field); ok && !strutil.StrListContains(overrides, field) {
+			overrides = append(overrides, field)
+		}
+	}
+	inherit := data.Get("inherit_token_params").([]string)
+	for _, field := range inherit {
+		if !strutil.StrListContains(tokenParamFields, field) {
+			return logical.ErrorResponse("invalid token parameter %q, must be one of %s", field, strings.Join(tokenParamFields, ", ")), nil
+		}
+	}
+	ks.TokenOverrides = []string{}
+	for _, field := range overrides {
+		if !strutil.StrListContains(inherit, field) {
+			ks.TokenOverrides = append(ks.TokenOverrides, field)
+		}
+	}
 
 	nextEligibleTime := data.Get("next_eligible_time").(string)
 	nextEligibleTimeUnix := ks.NextEligibleTime
@@ -142,6 +357,12 @@ func (b *backend) pathKeyWrite(ctx context.Context, req *logical.Request, data *
 		return logical.ErrorResponse("unvalid next_eligible_time %s", nextEligibleTime), err
 	}
 	ks.NextEligibleTime = nextEligibleTimeUnix
+	// reset to idle or disabled, the activation in progress is called off
+	if (nextEligibleTime != "" && ks.NextEligibleTime == 0) || ks.NextEligibleTime < 0 {
+		if err := b.endActiveRequest(ctx, req.Storage, &ks, requestStateCancelled, time.Now()); err != nil {
+			return nil, err
+		}
+	}
 
 	err = req.Storage.Put(ctx, &logical.StorageEntry{
 		Key:   "key-name-by-id/" + ks.PublicID,
@@ -158,6 +379,15 @@ func (b *backend) pathKeyWrite(ctx context.Context, req *logical.Request, data *
 	if err := req.Storage.Put(ctx, entry); err != nil {
 		return nil, err
 	}
+	if ks.NextEligibleTime < 0 {
+		result, err := b.revokeKeySessions(ctx, req.Storage, name)
+		if err == nil {
+			err = result.err()
+		}
+		if err != nil {
+			return logical.ErrorResponse("key is disabled but its sessions could not be revoked: %v", err), nil
+		}
+	}
 	return nil, nil
 }
 
@@ -174,7 +404,14 @@ func (b *backend) pathKeyRead(ctx context.Context, req *logical.Request, data *f
 	if err := entry.DecodeJSON(&ks); err != nil {
 		return nil, err
 	}
-	return &logical.Response{
+	aesKey, privateID := "", ""
+	if ks.AESKey != "" {
+		aesKey = strings.Repeat("*", 8)
+	}
+	if ks.PrivateID != "" {
+		privateID = strings.Repeat("*", 8)
+	}
+	resp := &logical.Response{
 		Data: map[string]interface{}{
 			"name":               name,
 			"alias":              ks.Alias,
@@ -183,13 +420,29 @@ func (b *backend) pathKeyRead(ctx context.Context, req *logical.Request, data *f
 			"delay":              ks.Delay,
 			"delay_mail":         ks.DelayMail,
 			"next_eligible_time": ks.NextEligibleTime,
+			"active_request":     ks.ActiveRequest,
+			"eligibility_window": ks.EligibilityWindow,
+			"session_cap":        ks.SessionCap,
+			"aes_key":            aesKey,
+			"private_id":         privateID,
+			"counter":            ks.Counter,
+			"session_use":        ks.SessionUse,
+			"max_counter_jump":   ks.MaxCounterJump,
+			"security_events":    ks.SecurityEvents,
+			"bad_otps":           ks.BadOTPs,
+			"recipients":         ks.Recipients,
+			"owner_email":        ks.OwnerEmail,
+			"token_overrides":    ks.tokenOverrides(),
 		},
-	}, nil
+	}
+	ks.PopulateTokenData(resp.Data)
+	return resp, nil
 
 }
 
 func (b *backend) pathKeyDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	name := data.Get("name").(string)
+	defer b.lockKey(name)()
 	entry, err := req.Storage.Get(ctx, "key/"+name)
 	if err != nil {
 		return nil, err
@@ -203,6 +456,16 @@ func (b *backend) pathKeyDelete(ctx context.Context, req *logical.Request, data
 		return nil, err
 	}
 
+	if err := b.endActiveRequest(ctx, req.Storage, &ks, requestStateCancelled, time.Now()); err != nil {
+		return nil, err
+	}
+
+	// the session records are kept if this fails so revoke-sessions can be retried
+	result, revokeErr := b.revokeKeySessions(ctx, req.Storage, name)
+	if revokeErr == nil {
+		revokeErr = result.err()
+	}
+
 	if err := req.Storage.Delete(ctx, "key/"+name); err != nil {
 		return nil, err
 	}
@@ -212,6 +475,9 @@ func (b *backend) pathKeyDelete(ctx context.Context, req *logical.Request, data
 		return nil, nil
 	}
 
+	if revokeErr != nil {
+		return logical.ErrorResponse("key is deleted but its sessions could not be revoked: %v", revokeErr), nil
+	}
 	return nil, nil
 }
 
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	// given up after deliveryMaxAttempts or because the channel is gone
+	deliveryFailed = "failed"
+)
+
+const (
+	// a failed delivery is retried after 30s, 1m, 2m, ... up to an hour apart
+	deliveryBackoff    = 30 * time.Second
+	deliveryMaxBackoff = time.Hour
+	// about a day of retries
+	deliveryMaxAttempts = 30
+	// finished deliveries are kept this long for the notifications/ log
+	deliveryRetention = 7 * 24 * time.Hour
+)
+
+// delivery is a notification to a single channel, kept in the outbox until it was sent or given up on.
+type delivery struct {
+	ID      string `json:"id"`
+	Channel string `json:"channel"`
+	Type    string `json:"type"`
+	State   string `json:"state"`
+	// as sent to the channel, Owner is set for owner channels
+	Notification *notification `json:"notification"`
+	Attempts     int           `json:"attempts"`
+	LastError    string        `json:"last_error"`
+	CreateTime   int64         `json:"create_time"`
+	LastAttempt  int64         `json:"last_attempt"`
+	NextAttempt  int64         `json:"next_attempt"`
+	// 0 until delivered
+	DeliveredTime int64 `json:"delivered_time"`
+}
+
+func putDelivery(ctx context.Context, s logical.Storage, d *delivery) error {
+	entry, err := logical.StorageEntryJSON("notification/"+d.ID, d)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func getDelivery(ctx context.Context, s logical.Storage, id string) (*delivery, error) {
+	entry, err := s.Get(ctx, "notification/"+id)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var d delivery
+	if err := entry.DecodeJSON(&d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func listDeliveries(ctx context.Context, s logical.Storage) ([]*delivery, error) {
+	ids, err := s.List(ctx, "notification/")
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]*delivery, 0, len(ids))
+	for _, id := range ids {
+		d, err := getDelivery(ctx, s, id)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].CreateTime < deliveries[j].CreateTime
+	})
+	return deliveries, nil
+}
+
+func newDelivery(c *notifyChannel, n *notification, now time.Time) (*delivery, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	return &delivery{
+		ID:           id,
+		Channel:      c.Name,
+		Type:         c.Type,
+		State:        deliveryPending,
+		Notification: n,
+		CreateTime:   now.Unix(),
+	}, nil
+}
+
+// retryBackoff is the wait after the given number of failed attempts.
+func retryBackoff(attempts int) time.Duration {
+	backoff := deliveryBackoff
+	for i := 1; i < attempts && backoff < deliveryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > deliveryMaxBackoff {
+		backoff = deliveryMaxBackoff
+	}
+	return backoff
+}
+
+// finished tells when a delivery stopped being retried, 0 if it is still pending.
+func (d *delivery) finished() int64 {
+	switch d.State {
+	case deliveryDelivered:
+		return d.DeliveredTime
+	case deliveryFailed:
+		return d.LastAttempt
+	}
+	return 0
+}
+
+// deliver makes one attempt to send the notification of d to channel c and records the outcome in d.
+func (b *backend) deliver(ctx context.Context, s logical.Storage, conf *emergencyOTPConfig, c *notifyChannel, d *delivery, now time.Time) error {
+	d.Attempts++
+	d.LastAttempt = now.Unix()
+	nt, err := c.notifier(conf, s)
+	if err == nil {
+		err = nt.Notify(ctx, d.Notification)
+	}
+	if err == nil {
+		d.State = deliveryDelivered
+		d.DeliveredTime = now.Unix()
+		d.NextAttempt = 0
+		d.LastError = ""
+		return nil
+	}
+
+	d.LastError = err.Error()
+	if d.Attempts >= deliveryMaxAttempts {
+		d.State = deliveryFailed
+		d.NextAttempt = 0
+		b.Logger().Error("giving up on notification", "id", d.ID, "channel", c.Name, "event", d.Notification.Event,
+			"key", d.Notification.KeyName, "attempts", d.Attempts, "error", err)
+	} else {
+		d.NextAttempt = now.Add(retryBackoff(d.Attempts)).Unix()
+		b.Logger().Error("failed to send notification", "id", d.ID, "channel", c.Name, "event", d.Notification.Event,
+			"key", d.Notification.KeyName, "attempts", d.Attempts, "error", err)
+	}
+	return err
+}
+
+// retryDeliveries retries pending notifications that are due and forgets old finished ones.
+func (b *backend) retryDeliveries(ctx context.Context, s logical.Storage, now time.Time) error {
+	deliveries, err := listDeliveries(ctx, s)
+	if err != nil {
+		return err
+	}
+	var conf *emergencyOTPConfig
+	for _, d := range deliveries {
+		if finished := d.finished(); finished != 0 {
+			if time.Unix(finished, 0).Add(deliveryRetention).Before(now) {
+				if err := s.Delete(ctx, "notification/"+d.ID); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if d.NextAttempt > now.Unix() {
+			continue
+		}
+		if conf == nil {
+			if conf, err = b.config(ctx, s); err != nil {
+				return err
+			}
+		}
+		// the channel may have been changed or removed since, its current settings are used
+		channels, err := b.notifyChannels(ctx, s, conf, d.Notification)
+		if err != nil {
+			return err
+		}
+		var channel *notifyChannel
+		for _, c := range channels {
+			if c.Name == d.Channel {
+				channel = c
+				break
+			}
+		}
+	if channel != nil && d.Notification.EscalationID != "" {
+			if channel, err = b.reachableTier(ctx, s, channel, d.Notification, now); err != nil {
+				return err
+			}
+			if channel == nil {
+				// nobody of the tier is reachable now, the retry waits without using up an attempt
+				d.NextAttempt = now.Add(retryBackoff(d.Attempts)).Unix()
+				if err := putDelivery(ctx, s, d); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if channel == nil {
+			d.State = deliveryFailed
+			d.LastError = "the channel does not exist anymore"
+			d.NextAttempt = 0
+		} else {
+			b.deliver(ctx, s, conf, channel, d, now)
+		}
+		if err := putDelivery(ctx, s, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backend) pathNotifications() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: `notifications/?$`,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathNotificationsRead,
+				},
+			},
+			HelpSynopsis: "List the notifications in the outbox and their delivery state",
+		},
+		{
+			Pattern: `notifications/(?P<id>[^/]+)$`,
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "ID of the notification",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathNotificationRead,
+				},
+			},
+			HelpSynopsis: "Read a notification and its delivery state",
+		},
+	}
+}
+
+func (d *delivery) statusData() map[string]interface{} {
+	return map[string]interface{}{
+		"id":                d.ID,
+		"channel":           d.Channel,
+		"type":              d.Type,
+		"event":             d.Notification.Event,
+		"key":               d.Notification.KeyName,
+		"request_id":        d.Notification.RequestID,
+		"state":             d.State,
+		"attempts":          d.Attempts,
+		"last_error":        d.LastError,
+		"create_time":       d.CreateTime,
+		"last_attempt_time": d.LastAttempt,
+		"next_attempt_time": d.NextAttempt,
+		"delivered_time":    d.DeliveredTime,
+	}
+}
+
+func (b *backend) pathNotificationsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	deliveries, err := listDeliveries(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]interface{}, 0, len(deliveries))
+	for _, d := range deliveries {
+		result = append(result, d.statusData())
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"notifications": result,
+		},
+	}, nil
+}
+
+func (b *backend) pathNotificationRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	d, err := getDelivery(ctx, req.Storage, data.Get("id").(string))
+	if err != nil || d == nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: d.statusData(),
+	}, nil
+}
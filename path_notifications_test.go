@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func testDelivery(t *testing.T, b *backend, s logical.Storage, id string) map[string]interface{} {
+	t.Helper()
+	resp, err := testRequest(b, s, logical.ReadOperation, "notifications/"+id, nil)
+	if err != nil || resp == nil {
+		t.Fatalf("failed to read notification %s: %v %v", id, resp, err)
+	}
+	return resp.Data
+}
+
+func TestNotificationOutbox(t *testing.T) {
+	b, s := testBackend(t)
+	ctx := context.Background()
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	flaky := map[string]interface{}{"type": "memory", "box": t.Name(), "events": "activation", "fail": true}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/flaky", flaky); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+		"delay":     60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	otp := testOTP(testPublicID, 1)
+	verifier.add(otp, otpStatusOK, 1, 1)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	denial := testDenial(t, resp, err)
+	results := denial["notifications"].([]notifyResult)
+	if len(results) != 1 || denial["notification_sent"] == true {
+		t.Fatalf("unexpected results %v", results)
+	}
+	id := results[0].ID
+
+	resp, err = testRequest(b, s, logical.ReadOperation, "notifications", nil)
+	if err != nil || len(resp.Data["notifications"].([]map[string]interface{})) != 1 {
+		t.Fatalf("unexpected outbox %v %v", resp, err)
+	}
+	d := testDelivery(t, b, s, id)
+	if d["channel"] != "flaky" || d["event"] != eventActivation || d["state"] != deliveryPending ||
+		d["attempts"] != 1 || d["last_error"] != "delivery failed" || d["delivered_time"] != int64(0) {
+		t.Errorf("unexpected notification %v", d)
+	}
+
+	// not due yet
+	now := time.Now()
+	if err := b.retryDeliveries(ctx, s, now); err != nil {
+		t.Fatal(err)
+	}
+	if d := testDelivery(t, b, s, id); d["attempts"] != 1 {
+		t.Errorf("retried too early: %v", d)
+	}
+	now = now.Add(time.Minute)
+	if err := b.retryDeliveries(ctx, s, now); err != nil {
+		t.Fatal(err)
+	}
+	if d := testDelivery(t, b, s, id); d["attempts"] != 2 || d["state"] != deliveryPending ||
+		d["next_attempt_time"] != now.Add(time.Minute).Unix() {
+		t.Errorf("unexpected retry %v", d)
+	}
+
+	// retries use the current settings of the channel
+	flaky["fail"] = false
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/flaky", flaky); err != nil || resp.IsError() {
+		t.Fatalf("failed to update channel: %v %v", resp, err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := b.retryDeliveries(ctx, s, now); err != nil {
+		t.Fatal(err)
+	}
+	if d := testDelivery(t, b, s, id); d["attempts"] != 3 || d["state"] != deliveryDelivered ||
+		d["delivered_time"] != now.Unix() || d["last_error"] != "" {
+		t.Errorf("unexpected delivery %v", d)
+	}
+	if sent := testNotifier.take(t.Name()); len(sent) != 1 || sent[0].Event != eventActivation || sent[0].KeyName != "somebody" {
+		t.Errorf("unexpected notifications %+v", sent)
+	}
+
+	if err := b.retryDeliveries(ctx, s, now.Add(deliveryRetention+time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := testRequest(b, s, logical.ReadOperation, "notifications/"+id, nil); err != nil || resp != nil {
+		t.Errorf("expected delivered notification to be forgotten, got %v %v", resp, err)
+	}
+}
+
+func TestNotificationChannelRemoved(t *testing.T) {
+	b, s := testBackend(t)
+	ctx := context.Background()
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/broken", map[string]interface{}{
+		"type": "memory", "box": t.Name(), "fail": true,
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	results, err := b.notify(ctx, s, &notification{Event: eventLogin, KeyName: "somebody"})
+	if err != nil || len(results) != 1 || results[0].Sent {
+		t.Fatalf("unexpected results %v %v", results, err)
+	}
+	if _, err := testRequest(b, s, logical.DeleteOperation, "notify/broken", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.retryDeliveries(ctx, s, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if d := testDelivery(t, b, s, results[0].ID); d["state"] != deliveryFailed || d["attempts"] != 1 {
+		t.Errorf("unexpected notification %v", d)
+	}
+
+	if got := retryBackoff(1); got != deliveryBackoff {
+		t.Errorf("unexpected first backoff %v", got)
+	}
+	if got := retryBackoff(deliveryMaxAttempts); got != deliveryMaxBackoff {
+		t.Errorf("unexpected last backoff %v", got)
+	}
+}
+
+// failingListStorage fails to list below prefix.
+type failingListStorage struct {
+	logical.Storage
+	prefix string
+}
+
+func (s *failingListStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	if strings.HasPrefix(prefix, s.prefix) {
+		return nil, errors.New("list failed")
+	}
+	return s.Storage.List(ctx, prefix)
+}
+
+func TestPeriodicRunsEveryStep(t *testing.T) {
+	b, s := testBackend(t)
+	ctx := context.Background()
+	flaky := map[string]interface{}{"type": "memory", "box": t.Name(), "fail": true}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/flaky", flaky); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	results, err := b.notify(ctx, s, &notification{Event: eventLogin, KeyName: "somebody"})
+	if err != nil || len(results) != 1 || results[0].Sent {
+		t.Fatalf("unexpected results %v %v", results, err)
+	}
+	d, err := getDelivery(ctx, s, results[0].ID)
+	if err != nil || d == nil || d.State != deliveryPending {
+		t.Fatalf("unexpected notification %+v %v", d, err)
+	}
+	d.NextAttempt = time.Now().Unix()
+	if err := putDelivery(ctx, s, d); err != nil {
+		t.Fatal(err)
+	}
+	flaky["fail"] = false
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/flaky", flaky); err != nil || resp.IsError() {
+		t.Fatalf("failed to update channel: %v %v", resp, err)
+	}
+	// pruning the sessions comes first and fails, the retry happens regardless
+	err = b.periodic(ctx, &logical.Request{Storage: &failingListStorage{Storage: s, prefix: "session/"}})
+	if err == nil || !strings.Contains(err.Error(), "list failed") {
+		t.Errorf("expected the pruning error, got %v", err)
+	}
+	if d := testDelivery(t, b, s, results[0].ID); d["attempts"] != 2 || d["state"] != deliveryDelivered {
+		t.Errorf("expected the notification to be retried, got %v", d)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func (b *backend) pathNotify() []*framework.Path {
+	fields := map[string]*framework.FieldSchema{
+		"name": {
+			Type:        framework.TypeString,
+			Description: "Name of the channel",
+		},
+		"type": {
+			Type:        framework.TypeString,
+			Description: "Type of the channel: " + strings.Join(channelTypeNames(), ", "),
+		},
+		"events": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Events sent to the channel: " + strings.Join(notifyEvents, ", ") + ". All if empty",
+		},
+		"throttle": {
+			Type:        framework.TypeDurationSecond,
+			Description: "How long repeated activation, login and security notifications of a key are held back after one was sent, defaults to 15m. 0 to send all",
+		},
+		"quiet_hours": {
+			Type:        framework.TypeString,
+			Description: "Daily period like 22:00-07:00 in which escalations skip the channel",
+		},
+		"time_zone": {
+			Type:        framework.TypeString,
+			Description: "IANA time zone of quiet_hours, e.g. Europe/Berlin. UTC if empty",
+		},
+	}
+	// types share some fields, the help of the first type in order is shown
+	for _, typeName := range channelTypeNames() {
+		for name, schema := range channelTypes[typeName].Fields {
+			if _, ok := fields[name]; !ok {
+				fields[name] = schema
+			}
+		}
+	}
+
+	return []*framework.Path{
+		{
+			Pattern: `notify/(?P<name>[\w.-]+)$`,
+			Fields:  fields,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathNotifyWrite,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathNotifyWrite,
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathNotifyRead,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathNotifyDelete,
+				},
+			},
+			HelpSynopsis: "Manage notification channels",
+		},
+		{
+			Pattern: `notify/?$`,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathNotifyList,
+				},
+			},
+			HelpSynopsis: "List notification channels",
+		},
+	}
+}
+
+func channelTypeNames() []string {
+	names := make([]string, 0, len(channelTypes))
+	for name := range channelTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *backend) pathNotifyWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if name == defaultEmailChannel {
+		return logical.ErrorResponse("%s is the channel made from smtp_to in the mount config", defaultEmailChannel), nil
+	}
+	if name == ownerEmailChannel {
+		return logical.ErrorResponse("%s is the channel made from owner_email of the keys", ownerEmailChannel), nil
+	}
+
+	c, err := getNotifyChannel(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		c = &notifyChannel{Name: name}
+	}
+
+	channelTypeName, ok := data.GetOk("type")
+	if ok && channelTypeName.(string) != c.Type {
+		// settings of another type mean nothing
+		c.Type = channelTypeName.(string)
+		c.Settings = nil
+	}
+	t, ok := channelTypes[c.Type]
+	if !ok {
+		return logical.ErrorResponse("invalid type %q, must be one of %s", c.Type, strings.Join(channelTypeNames(), ", ")), nil
+	}
+
+	events, ok := data.GetOk("events")
+	if ok {
+		c.Events = events.([]string)
+	}
+	for _, e := range c.Events {
+		if !strutil.StrListContains(notifyEvents, e) {
+			return logical.ErrorResponse("invalid event %q, must be one of %s", e, strings.Join(notifyEvents, ", ")), nil
+		}
+	}
+
+	throttle, ok := data.GetOk("throttle")
+	if ok {
+		seconds := int64(throttle.(int))
+		if seconds < 0 {
+			return logical.ErrorResponse("throttle must not be negative"), nil
+		}
+		c.Throttle = &seconds
+	}
+
+	quietHours, ok := data.GetOk("quiet_hours")
+	if ok {
+		c.QuietHours = quietHours.(string)
+	}
+	timeZone, ok := data.GetOk("time_zone")
+	if ok {
+		c.TimeZone = timeZone.(string)
+	}
+	if _, err := parseQuietHours(c.QuietHours, c.TimeZone); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if c.Settings == nil {
+		c.Settings = make(map[string]interface{})
+	}
+	for field := range t.Fields {
+		if v, ok := data.GetOk(field); ok {
+			c.Settings[field] = v
+		}
+	}
+
+	conf, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.notifier(conf, req.Storage); err != nil {
+		return logical.ErrorResponse("channel config not valid: %v", err), nil
+	}
+
+	entry, err := logical.StorageEntryJSON("notify/"+name, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *backend) pathNotifyRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	c, err := getNotifyChannel(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return logical.ErrorResponse("could not find channel named %s", name), nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name":        c.Name,
+			"type":        c.Type,
+			"events":      c.Events,
+			"throttle":    int64(c.throttle() / time.Second),
+			"quiet_hours": c.QuietHours,
+			"time_zone":   c.TimeZone,
+		},
+	}
+	if t, ok := channelTypes[c.Type]; ok {
+		settings := c.settings()
+		for field, schema := range t.Fields {
+			v, ok := settings.GetOk(field)
+			if ok && schema.DisplayAttrs != nil && schema.DisplayAttrs.Sensitive {
+				v = maskSetting(v)
+			}
+			if ok {
+				resp.Data[field] = v
+			}
+		}
+	}
+	return resp, nil
+}
+
+// maskSetting hides a sensitive setting on read, key-value pairs keep their keys, e.g. header names.
+func maskSetting(v interface{}) interface{} {
+	mask := strings.Repeat("*", 8)
+	pairs, ok := v.(map[string]string)
+	if !ok {
+		return mask
+	}
+	masked := make(map[string]string, len(pairs))
+	for k := range pairs {
+		masked[k] = mask
+	}
+	return masked
+}
+
+func (b *backend) pathNotifyDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	if err := req.Storage.Delete(ctx, "notify/"+name); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *backend) pathNotifyList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, "notify/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(names), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// emailRecipient holds what is known about an email address notifications are sent to.
+type emailRecipient struct {
+	Address string `json:"address"`
+	// armored, notifications to the address are encrypted to it if set
+	PGPPublicKey string `json:"pgp_public_key"`
+	// escalations skip the address in its quiet hours, see parseQuietHours
+	QuietHours string `json:"quiet_hours"`
+	TimeZone   string `json:"time_zone"`
+}
+
+// recipientAddress is the bare, lower case address of an email recipient like "Somebody <somebody@example.com>".
+func recipientAddress(recipient string) string {
+	if addr, err := mail.ParseAddress(recipient); err == nil {
+		recipient = addr.Address
+	}
+	return strings.ToLower(strings.TrimSpace(recipient))
+}
+
+func getEmailRecipient(ctx context.Context, s logical.Storage, address string) (*emailRecipient, error) {
+	entry, err := s.Get(ctx, "recipient/"+recipientAddress(address))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	r := &emailRecipient{}
+	if err := entry.DecodeJSON(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (b *backend) pathRecipients() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: `recipient/(?P<address>[^/]+)$`,
+			Fields: map[string]*framework.FieldSchema{
+				"address": {
+					Type:        framework.TypeString,
+					Description: "Email address of the recipient",
+				},
+				"pgp_public_key": {
+					Type:        framework.TypeString,
+					Description: "Armored OpenPGP public key, emails to the recipient are encrypted to it",
+				},
+				"quiet_hours": {
+					Type:        framework.TypeString,
+					Description: "Daily period like 22:00-07:00 in which escalations skip the recipient",
+				},
+				"time_zone": {
+					Type:        framework.TypeString,
+					Description: "IANA time zone of quiet_hours, e.g. Europe/Berlin. UTC if empty",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRecipientWrite,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathRecipientWrite,
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathRecipientRead,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathRecipientDelete,
+				},
+			},
+			HelpSynopsis: "Manage email recipients",
+		},
+		{
+			Pattern: `recipient/?$`,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathRecipientList,
+				},
+			},
+			HelpSynopsis: "List email recipients",
+		},
+	}
+}
+
+func (b *backend) pathRecipientWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	address := recipientAddress(data.Get("address").(string))
+	if _, err := mail.ParseAddress(address); err != nil {
+		return logical.ErrorResponse("invalid address %q", address), nil
+	}
+	r, err := getEmailRecipient(ctx, req.Storage, address)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		r = &emailRecipient{Address: address}
+	}
+
+	fieldPGPPublicKey, ok := data.GetOk("pgp_public_key")
+	if ok {
+		r.PGPPublicKey = fieldPGPPublicKey.(string)
+	}
+	fieldQuietHours, ok := data.GetOk("quiet_hours")
+	if ok {
+		r.QuietHours = fieldQuietHours.(string)
+	}
+	fieldTimeZone, ok := data.GetOk("time_zone")
+	if ok {
+		r.TimeZone = fieldTimeZone.(string)
+	}
+	if _, err := parseQuietHours(r.QuietHours, r.TimeZone); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	var resp *logical.Response
+	if r.PGPPublicKey != "" {
+		entity, err := readPGPPublicKey(r.PGPPublicKey)
+		if err != nil {
+			return logical.ErrorResponse("pgp_public_key not valid: %v", err), nil
+		}
+		if !pgpHasIdentity(entity, address) {
+			resp = &logical.Response{}
+			resp.AddWarning(fmt.Sprintf("no user ID of key %s is for %s", pgpFingerprint(entity), address))
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON("recipient/"+address, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (b *backend) pathRecipientRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	address := data.Get("address").(string)
+	r, err := getEmailRecipient(ctx, req.Storage, address)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return logical.ErrorResponse("could not find recipient %s", address), nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"address":         r.Address,
+			"pgp_public_key":  r.PGPPublicKey,
+			"pgp_fingerprint": "",
+			"quiet_hours":     r.QuietHours,
+			"time_zone":       r.TimeZone,
+		},
+	}
+	if r.PGPPublicKey != "" {
+		if entity, err := readArmoredEntity(r.PGPPublicKey); err == nil {
+			resp.Data["pgp_fingerprint"] = pgpFingerprint(entity)
+		}
+	}
+	return resp, nil
+}
+
+func (b *backend) pathRecipientDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, "recipient/"+recipientAddress(data.Get("address").(string))); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *backend) pathRecipientList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	addresses, err := req.Storage.List(ctx, "recipient/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(addresses), nil
+}
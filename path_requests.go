@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	requestStatePending   = "pending"
+	requestStateEligible  = "eligible"
+	requestStateConsumed  = "consumed"
+	requestStateExpired   = "expired"
+	requestStateCancelled = "cancelled"
+)
+
+// finished requests are forgotten after this long
+const requestRetention = 30 * 24 * time.Hour
+
+// activationRequest is one emergency activation of a key, from the first login until the
+// eligibility ran out or an operator reset the key. A consumed request stays open while the key is
+// eligible and can still expire or be cancelled, consume_time tells that a token was issued.
+type activationRequest struct {
+	ID         string `json:"id"`
+	KeyName    string `json:"key_name"`
+	PublicID   string `json:"public_id"`
+	State      string `json:"state"`
+	RemoteAddr string `json:"remote_addr"`
+	// for notifications sent without a request at hand
+	MountPoint string `json:"mount_point"`
+	// sha256 of the secret that allows polling the status, the secret itself is only handed out once
+	SecretHash string `json:"secret_hash"`
+
+	CreateTime int64 `json:"create_time"`
+	// NextEligibleTime of the key, follows changes made by operators while the request is open
+	EligibleTime int64 `json:"eligible_time"`
+	// first token issued
+	ConsumeTime int64 `json:"consume_time"`
+	// expired or cancelled
+	EndTime int64 `json:"end_time"`
+}
+
+// finished tells whether the request ended. A consumed request has not, it ends with the eligibility of
+// the key so channels following the activation learn when it is over.
+func (r *activationRequest) finished() bool {
+	return r.State == requestStateExpired || r.State == requestStateCancelled
+}
+
+func (r *activationRequest) end(state string, now time.Time) {
+	r.State = state
+	r.EndTime = now.Unix()
+}
+
+// advance moves the request along with its key, it returns whether anything changed.
+// key is nil if the key was deleted. A NextEligibleTime of 0 is a request waiting for an operator.
+func (r *activationRequest) advance(key *keyState, now time.Time) bool {
+	if r.finished() {
+		return false
+	}
+	if key == nil || key.ActiveRequest != r.ID || key.NextEligibleTime < 0 {
+		r.end(requestStateCancelled, now)
+		return true
+	}
+	if key.eligibilityExpired(now) {
+		r.end(requestStateExpired, now)
+		return true
+	}
+	changed := r.EligibleTime != key.NextEligibleTime
+	r.EligibleTime = key.NextEligibleTime
+	if r.State == requestStatePending && key.eligible(now) {
+		r.State = requestStateEligible
+		changed = true
+	}
+	return changed
+}
+
+func (r *activationRequest) checkSecret(secret string) bool {
+	sum := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(r.SecretHash)) == 1
+}
+
+// newActivationRequest opens a request for the key and makes it the active one.
+// It returns the status secret, which is not stored.
+func newActivationRequest(req *logical.Request, key *keyState, now time.Time) (*activationRequest, string, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, "", err
+	}
+	secretBytes, err := uuid.GenerateRandomBytes(16)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := hex.EncodeToString(secretBytes)
+	sum := sha256.Sum256([]byte(secret))
+
+	r := &activationRequest{
+		ID:           id,
+		KeyName:      key.Name,
+		PublicID:     key.PublicID,
+		State:        requestStatePending,
+		SecretHash:   hex.EncodeToString(sum[:]),
+		CreateTime:   now.Unix(),
+		EligibleTime: key.NextEligibleTime,
+		MountPoint:   req.MountPoint,
+	}
+	if req.Connection != nil {
+		r.RemoteAddr = req.Connection.RemoteAddr
+	}
+	key.ActiveRequest = id
+	return r, secret, nil
+}
+
+func putActivationRequest(ctx context.Context, s logical.Storage, r *activationRequest) error {
+	entry, err := logical.StorageEntryJSON("request/"+r.ID, r)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func getActivationRequest(ctx context.Context, s logical.Storage, id string) (*activationRequest, error) {
+	entry, err := s.Get(ctx, "request/"+id)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var r activationRequest
+	if err := entry.DecodeJSON(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// saveActivationRequest persists the request and tells the channels if its state moved on from prevState.
+// That the request became eligible is left to the eligible event of remindKeys. key is nil if the key was deleted.
+func (b *backend) saveActivationRequest(ctx context.Context, s logical.Storage, r *activationRequest, prevState string, key *keyState) error {
+	if err := putActivationRequest(ctx, s, r); err != nil {
+		return err
+	}
+	if r.State == prevState || r.State == requestStateEligible {
+		return nil
+	}
+	n := &notification{
+		Event:            eventRequest,
+		Time:             time.Now().Unix(),
+		MountPoint:       r.MountPoint,
+		RemoteAddr:       r.RemoteAddr,
+		KeyName:          r.KeyName,
+		PublicID:         r.PublicID,
+		NextEligibleTime: r.EligibleTime,
+		RequestID:        r.ID,
+		RequestState:     r.State,
+	}
+	if key != nil {
+		n.KeyAlias = key.Alias
+		n.EntityID = key.EntityID
+		n.Delay = key.Delay
+		n.DelayMail = key.DelayMail
+	}
+	// failures are logged by notify, the state change stands regardless
+	if _, err := b.notify(ctx, s, n); err != nil {
+		b.Logger().Error("failed to send request notification", "key", r.KeyName, "request", r.ID, "error", err)
+	}
+	return nil
+}
+
+// endActiveRequest finishes the active request of the key, if any, and detaches it.
+// The caller is responsible for persisting the key.
+func (b *backend) endActiveRequest(ctx context.Context, s logical.Storage, key *keyState, state string, now time.Time) error {
+	if key.ActiveRequest == "" {
+		return nil
+	}
+	r, err := getActivationRequest(ctx, s, key.ActiveRequest)
+	if err != nil {
+		return err
+	}
+	key.ActiveRequest = ""
+	if r == nil || r.finished() {
+		return nil
+	}
+	prevState := r.State
+	r.end(state, now)
+	return b.saveActivationRequest(ctx, s, r, prevState, key)
+}
+
+// advanceRequests catches up open requests with their keys and forgets old finished ones.
+func (b *backend) advanceRequests(ctx context.Context, s logical.Storage) error {
+	ids, err := s.List(ctx, "request/")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, id := range ids {
+		r, err := getActivationRequest(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			continue
+		}
+		if r.finished() {
+			if time.Unix(r.EndTime, 0).Add(requestRetention).Before(now) {
+				if err := s.Delete(ctx, "request/"+id); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		key, err := b.key(ctx, s, r.KeyName)
+		if err != nil {
+			return err
+		}
+		prevState := r.State
+		if r.advance(key, now) {
+			if err := b.saveActivationRequest(ctx, s, r, prevState, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *backend) pathRequests() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: `request/(?P<id>[^/]+)/status$`,
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "ID of the activation request",
+				},
+				"secret": {
+					Type:        framework.TypeString,
+					Description: "Status secret returned with the activation request",
+					DisplayAttrs: &framework.DisplayAttributes{
+						Sensitive: true,
+					},
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathRequestStatus,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRequestStatus,
+				},
+			},
+			HelpSynopsis: "Poll the state of an activation request without an OTP",
+		},
+		{
+			Pattern: `request/(?P<id>[^/]+)$`,
+			Fields: map[string]*framework.FieldSchema{
+				"id": {
+					Type:        framework.TypeString,
+					Description: "ID of the activation request",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathRequestRead,
+				},
+			},
+			HelpSynopsis: "Read an activation request",
+		},
+		{
+			Pattern: `request/?$`,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathRequestList,
+				},
+			},
+			HelpSynopsis: "List activation requests",
+		},
+	}
+}
+
+// loadActivationRequest reads a request and brings it up to date with its key.
+func (b *backend) loadActivationRequest(ctx context.Context, s logical.Storage, id string) (*activationRequest, error) {
+	r, err := getActivationRequest(ctx, s, id)
+	if err != nil || r == nil {
+		return r, err
+	}
+	return r, b.refreshActivationRequest(ctx, s, r)
+}
+
+// refreshActivationRequest brings a request up to date with its key, saving and notifying if it moved on.
+func (b *backend) refreshActivationRequest(ctx context.Context, s logical.Storage, r *activationRequest) error {
+	if r.finished() {
+		return nil
+	}
+	key, err := b.key(ctx, s, r.KeyName)
+	if err != nil {
+		return err
+	}
+	prevState := r.State
+	if r.advance(key, time.Now()) {
+		return b.saveActivationRequest(ctx, s, r, prevState, key)
+	}
+	return nil
+}
+
+func (r *activationRequest) statusData(now time.Time) map[string]interface{} {
+	data := map[string]interface{}{
+		"id":            r.ID,
+		"state":         r.State,
+		"create_time":   r.CreateTime,
+		"eligible_time": r.EligibleTime,
+		"consume_time":  r.ConsumeTime,
+		"end_time":      r.EndTime,
+	}
+	if r.State == requestStatePending && r.EligibleTime > now.Unix() {
+		data["seconds_remaining"] = r.EligibleTime - now.Unix()
+	} else {
+		data["seconds_remaining"] = 0
+	}
+	return data
+}
+
+func (b *backend) pathRequestStatus(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	id := data.Get("id").(string)
+	secret := data.Get("secret").(string)
+	r, err := getActivationRequest(ctx, req.Storage, id)
+	if err != nil {
+		return nil, err
+	}
+	// do not tell apart unknown requests and wrong secrets, nothing is written before the secret is checked
+	if r == nil || secret == "" || !r.checkSecret(secret) {
+		return logical.ErrorResponse("unknown activation request or wrong secret"), logical.ErrPermissionDenied
+	}
+	if err := b.refreshActivationRequest(ctx, req.Storage, r); err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: r.statusData(time.Now()),
+	}, nil
+}
+
+func (b *backend) pathRequestRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	id := data.Get("id").(string)
+	r, err := b.loadActivationRequest(ctx, req.Storage, id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return logical.ErrorResponse("could not find activation request %s", id), nil
+	}
+	resp := &logical.Response{
+		Data: r.statusData(time.Now()),
+	}
+	resp.Data["key_name"] = r.KeyName
+	resp.Data["public_id"] = r.PublicID
+	resp.Data["remote_addr"] = r.RemoteAddr
+	return resp, nil
+}
+
+func (b *backend) pathRequestList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	ids, err := req.Storage.List(ctx, "request/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(ids), nil
+}
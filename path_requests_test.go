@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// testPendingRequest logs in with a key in its waiting period and returns the request ID and status secret.
+func testPendingRequest(t *testing.T, b *backend, s logical.Storage, verifier *memoryVerifier, n int) (string, string) {
+	t.Helper()
+	otp := testOTP(testPublicID, n)
+	verifier.add(otp, otpStatusOK, 1, int64(n))
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	denial := testDenial(t, resp, err)
+	id, _ := denial["request_id"].(string)
+	secret, _ := denial["request_secret"].(string)
+	if id == "" || secret == "" {
+		t.Fatalf("no activation request in %v", denial)
+	}
+	return id, secret
+}
+
+func testRequestState(t *testing.T, b *backend, s logical.Storage, id string, secret string) string {
+	t.Helper()
+	resp, err := testRequest(b, s, logical.ReadOperation, "request/"+id+"/status", map[string]interface{}{"secret": secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Data["state"].(string)
+}
+
+func TestActivationRequestLifecycle(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+		"delay":     60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	id, secret := testPendingRequest(t, b, s, verifier, 1)
+	if state := testRequestState(t, b, s, id, secret); state != requestStatePending {
+		t.Errorf("expected pending, got %s", state)
+	}
+	if _, err := testRequest(b, s, logical.ReadOperation, "request/"+id+"/status", map[string]interface{}{"secret": "wrong"}); err != logical.ErrPermissionDenied {
+		t.Errorf("expected wrong secret to be denied, got %v", err)
+	}
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"next_eligible_time": "1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a wrong secret does not move the request along
+	if _, err := testRequest(b, s, logical.ReadOperation, "request/"+id+"/status", map[string]interface{}{"secret": "wrong"}); err != logical.ErrPermissionDenied {
+		t.Errorf("expected wrong secret to be denied, got %v", err)
+	}
+	if r, err := getActivationRequest(context.Background(), s, id); err != nil || r.State != requestStatePending {
+		t.Errorf("request advanced without the secret: %+v %v", r, err)
+	}
+	if state := testRequestState(t, b, s, id, secret); state != requestStateEligible {
+		t.Errorf("expected eligible, got %s", state)
+	}
+
+	otp := testOTP(testPublicID, 2)
+	verifier.add(otp, otpStatusOK, 1, 2)
+	resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if err != nil || resp.Auth == nil {
+		t.Fatalf("expected login, got %v %v", resp, err)
+	}
+	if resp.Auth.Metadata["yubikey_request_id"] != id {
+		t.Errorf("token not tied to request %s: %v", id, resp.Auth.Metadata)
+	}
+	if state := testRequestState(t, b, s, id, secret); state != requestStateConsumed {
+		t.Errorf("expected consumed, got %s", state)
+	}
+
+	resp, err = testRequest(b, s, logical.ReadOperation, "request/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["key_name"] != "somebody" || resp.Data["remote_addr"] != "192.0.2.1" || resp.Data["consume_time"].(int64) == 0 {
+		t.Errorf("unexpected request %v", resp.Data)
+	}
+
+	// consumed is not terminal: more logins while the key is eligible belong to the same activation, and it
+	// still ends when the key is disabled, which resolves incidents and escalations of the activation
+	otp = testOTP(testPublicID, 3)
+	verifier.add(otp, otpStatusOK, 1, 3)
+	resp, err = testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+	if err != nil || resp.Auth == nil || resp.Auth.Metadata["yubikey_request_id"] != id {
+		t.Fatalf("expected login within request %s, got %v %v", id, resp, err)
+	}
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"next_eligible_time": "-1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if state := testRequestState(t, b, s, id, secret); state != requestStateCancelled {
+		t.Errorf("expected the consumed request to be cancelled, got %s", state)
+	}
+}
+
+func TestActivationRequestCancelled(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+		"delay":     60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	id, secret := testPendingRequest(t, b, s, verifier, 1)
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"next_eligible_time": "0",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if state := testRequestState(t, b, s, id, secret); state != requestStateCancelled {
+		t.Errorf("expected cancelled, got %s", state)
+	}
+
+	// the next login opens a new request
+	newID, _ := testPendingRequest(t, b, s, verifier, 2)
+	if newID == id {
+		t.Error("cancelled request was reused")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// keySession is a token issued to an emergency key.
+// The accessor is not known when the token is issued, it is filled in on the first renewal. A token that
+// was never renewed can not be revoked: its session is kept as revoked, so its renewals are refused, until
+// its first TTL ran out.
+type keySession struct {
+	ID       string `json:"id"`
+	KeyName  string `json:"key_name"`
+	Accessor string `json:"accessor"`
+	// the eligibility the token was issued in
+	Activation    string `json:"activation"`
+	RemoteAddr    string `json:"remote_addr"`
+	IssueTime     int64  `json:"issue_time"`
+	LastRenewTime int64  `json:"last_renew_time"`
+	// 0 if the token may be renewed indefinitely
+	ExpireTime int64 `json:"expire_time"`
+	// end of the first TTL of the token, 0 for sessions recorded before it was
+	TokenExpireTime int64 `json:"token_expire_time"`
+	// revoked before the accessor was known
+	Revoked bool `json:"revoked"`
+}
+
+// sessionRevocation is the outcome of revoking the sessions of a key.
+type sessionRevocation struct {
+	Revoked int
+	// tokens that were never renewed and are still valid, until ValidUntil (0 if not known)
+	Unrevoked  int
+	ValidUntil int64
+}
+
+// err tells about the tokens that could not be revoked, nil if there are none.
+func (r *sessionRevocation) err() error {
+	if r.Unrevoked == 0 {
+		return nil
+	}
+	until := "the end of their TTL"
+	if r.ValidUntil > 0 {
+		until = time.Unix(r.ValidUntil, 0).UTC().Format(time.RFC3339)
+	}
+	return fmt.Errorf("%d tokens were never renewed, their accessor is not known so they can not be revoked and stay valid until %s; "+
+		"their renewals are refused, revoke-sessions of the mount revokes them", r.Unrevoked, until)
+}
+
+func sessionStoragePath(keyName string, id string) string {
+	return "session/" + keyName + "/" + id
+}
+
+func putSession(ctx context.Context, s logical.Storage, sess *keySession) error {
+	entry, err := logical.StorageEntryJSON(sessionStoragePath(sess.KeyName, sess.ID), sess)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func getSession(ctx context.Context, s logical.Storage, keyName string, id string) (*keySession, error) {
+	entry, err := s.Get(ctx, sessionStoragePath(keyName, id))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var sess keySession
+	if err := entry.DecodeJSON(&sess); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func listSessions(ctx context.Context, s logical.Storage, keyName string) ([]*keySession, error) {
+	ids, err := s.List(ctx, "session/"+keyName+"/")
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*keySession, 0, len(ids))
+	for _, id := range ids {
+		sess, err := getSession(ctx, s, keyName, id)
+		if err != nil {
+			return nil, err
+		}
+		if sess != nil {
+			sessions = append(sessions, sess)
+		}
+	}
+	return sessions, nil
+}
+
+// revokeKeySessions revokes every token issued to the key and forgets about them. Tokens whose accessor is not
+// known yet can not be revoked, their sessions are kept as revoked while the tokens may be valid.
+func (b *backend) revokeKeySessions(ctx context.Context, s logical.Storage, keyName string) (*sessionRevocation, error) {
+	result := &sessionRevocation{}
+	sessions, err := listSessions(ctx, s, keyName)
+	if err != nil || len(sessions) == 0 {
+		return result, err
+	}
+
+	now := time.Now().Unix()
+	untilUnknown := false
+	var revoker tokenRevoker
+	for _, sess := range sessions {
+		if sess.Accessor == "" {
+			if sess.TokenExpireTime == 0 || sess.TokenExpireTime > now {
+				result.Unrevoked++
+				untilUnknown = untilUnknown || sess.TokenExpireTime == 0
+				if sess.TokenExpireTime > result.ValidUntil {
+					result.ValidUntil = sess.TokenExpireTime
+				}
+				if !sess.Revoked {
+					sess.Revoked = true
+					if err := putSession(ctx, s, sess); err != nil {
+						return result, err
+					}
+				}
+				continue
+			}
+		} else {
+			if revoker == nil {
+				conf, err := b.config(ctx, s)
+				if err != nil {
+					return result, err
+				}
+				if revoker, err = b.newRevoker(conf); err != nil {
+					return result, err
+				}
+			}
+			if err := revoker.RevokeAccessor(ctx, sess.Accessor); err != nil {
+				return result, fmt.Errorf("failed to revoke session %s: %w", sess.ID, err)
+			}
+			result.Revoked++
+		}
+		if err := s.Delete(ctx, sessionStoragePath(keyName, sess.ID)); err != nil {
+			return result, err
+		}
+	}
+	if untilUnknown {
+		result.ValidUntil = 0
+	}
+	b.Logger().Info("revoked sessions of key", "key", keyName, "count", result.Revoked, "unrevoked", result.Unrevoked)
+	return result, nil
+}
+
+// splitSessionPath splits a path relative to session/ into the key name, which may contain slashes, and the session ID.
+func splitSessionPath(path string) (string, string, bool) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", "", false
+	}
+	return path[:i], path[i+1:], true
+}
+
+// pruneSessions forgets sessions whose token can not be alive anymore.
+func (b *backend) pruneSessions(ctx context.Context, s logical.Storage) error {
+	paths, err := listRecursive(ctx, s, "session/")
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, path := range paths {
+		keyName, id, ok := splitSessionPath(path)
+		if !ok {
+			continue
+		}
+		sess, err := getSession(ctx, s, keyName, id)
+		if err != nil {
+			return err
+		}
+		if sess == nil {
+			continue
+		}
+		// revoked sessions are kept while their token may be valid
+		if sess.ExpireTime > 0 && sess.ExpireTime < now || sess.Revoked && sess.TokenExpireTime > 0 && sess.TokenExpireTime < now {
+			if err := s.Delete(ctx, sessionStoragePath(keyName, id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *backend) pathSessions() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: `key/(?P<name>.+)/sessions$`,
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the key",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathKeySessionsRead,
+				},
+			},
+			HelpSynopsis: "List the tokens issued to a key",
+		},
+		{
+			Pattern: `key/(?P<name>.+)/revoke-sessions$`,
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the key",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathKeySessionsRevoke,
+				},
+			},
+			HelpSynopsis: "Revoke all tokens issued to a key",
+		},
+		{
+			Pattern: `revoke-sessions$`,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathSessionsRevokeAll,
+				},
+			},
+			HelpSynopsis: "Revoke every token issued by this mount",
+		},
+	}
+}
+
+func (b *backend) pathKeySessionsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	sessions, err := listSessions(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]interface{}, 0, len(sessions))
+	for _, sess := range sessions {
+		result = append(result, map[string]interface{}{
+			"id":                sess.ID,
+			"accessor":          sess.Accessor,
+			"activation":        sess.Activation,
+			"remote_addr":       sess.RemoteAddr,
+			"issue_time":        sess.IssueTime,
+			"last_renew_time":   sess.LastRenewTime,
+			"expire_time":       sess.ExpireTime,
+			"token_expire_time": sess.TokenExpireTime,
+			"revoked":           sess.Revoked,
+		})
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"sessions": result,
+		},
+	}, nil
+}
+
+func (b *backend) pathKeySessionsRevoke(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	result, err := b.revokeKeySessions(ctx, req.Storage, name)
+	if err != nil {
+		return logical.ErrorResponse("failed to revoke sessions: %v", err), nil
+	}
+	revocationData := map[string]interface{}{
+		"revoked":     result.Revoked,
+		"unrevoked":   result.Unrevoked,
+		"valid_until": result.ValidUntil,
+	}
+	// not a success while tokens of the key are valid
+	if err := result.err(); err != nil {
+		resp := logical.ErrorResponse("failed to revoke sessions: %v", err)
+		resp.Data["data"] = revocationData
+		return resp, nil
+	}
+	return &logical.Response{Data: revocationData}, nil
+}
+
+func (b *backend) pathSessionsRevokeAll(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	conf, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	revoker, err := b.newRevoker(conf)
+	if err != nil {
+		return logical.ErrorResponse("failed to revoke sessions: %v", err), nil
+	}
+	// this catches tokens issued before sessions were tracked too
+	if err := revoker.RevokePrefix(ctx, req.MountPoint+"login"); err != nil {
+		return logical.ErrorResponse("failed to revoke sessions: %v", err), nil
+	}
+
+	paths, err := listRecursive(ctx, req.Storage, "session/")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if err := req.Storage.Delete(ctx, "session/"+path); err != nil {
+			return nil, err
+		}
+	}
+	b.Logger().Warn("revoked every session of the mount")
+	return nil, nil
+}
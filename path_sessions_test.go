@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// fakeRevoker records revocations instead of calling Vault.
+type fakeRevoker struct {
+	revoked  []string
+	prefixes []string
+}
+
+func (r *fakeRevoker) RevokeAccessor(ctx context.Context, accessor string) error {
+	r.revoked = append(r.revoked, accessor)
+	return nil
+}
+
+func (r *fakeRevoker) RevokePrefix(ctx context.Context, prefix string) error {
+	r.prefixes = append(r.prefixes, prefix)
+	return nil
+}
+
+func TestDisableKeyRevokesSessions(t *testing.T) {
+	b, s := testBackend(t)
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+	revoker := &fakeRevoker{}
+	b.newRevoker = func(conf *emergencyOTPConfig) (tokenRevoker, error) {
+		return revoker, nil
+	}
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id":          testPublicID,
+		"next_eligible_time": "1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var auths []*logical.Auth
+	for i := 1; i <= 2; i++ {
+		otp := testOTP(testPublicID, i)
+		verifier.add(otp, otpStatusOK, 1, int64(i))
+		resp, err := testRequest(b, s, logical.UpdateOperation, "login", map[string]interface{}{"otp_response": otp})
+		if err != nil || resp.Auth == nil {
+			t.Fatalf("expected login, got %v %v", resp, err)
+		}
+		auths = append(auths, resp.Auth)
+	}
+
+	// the first token is renewed so its accessor is learned, the second never is
+	auths[0].Accessor = "accessor-1"
+	if _, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RenewOperation,
+		Path:      "login",
+		Storage:   s,
+		Auth:      auths[0],
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := testRequest(b, s, logical.ReadOperation, "key/somebody/sessions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions := resp.Data["sessions"].([]map[string]interface{}); len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %v", sessions)
+	}
+
+	// the second token stays valid, which is not reported as success
+	resp, err = testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"next_eligible_time": "-1",
+	})
+	if err != nil || !resp.IsError() || !strings.Contains(resp.Error().Error(), "1 tokens were never renewed") {
+		t.Fatalf("expected disabling the key to report the token left, got %v %v", resp, err)
+	}
+	if strings.Join(revoker.revoked, ",") != "accessor-1" {
+		t.Errorf("unexpected revocations %v", revoker.revoked)
+	}
+	resp, err = testRequest(b, s, logical.UpdateOperation, "key/somebody/revoke-sessions", nil)
+	if err != nil || !resp.IsError() || resp.Data["data"].(map[string]interface{})["unrevoked"] != 1 {
+		t.Errorf("expected revoke-sessions to report the token left, got %v %v", resp, err)
+	}
+
+	resp, err = testRequest(b, s, logical.ReadOperation, "key/somebody/sessions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := resp.Data["sessions"].([]map[string]interface{})
+	if len(sessions) != 1 || sessions[0]["revoked"] != true || sessions[0]["accessor"] != "" {
+		t.Errorf("expected only the unrevoked session to be kept: %v", sessions)
+	}
+
+	// the token without a known accessor is not renewed even once the key is usable again
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"next_eligible_time": "1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RenewOperation,
+		Path:      "login",
+		Storage:   s,
+		Auth:      auths[1],
+	}); err != logical.ErrPermissionDenied {
+		t.Errorf("expected renewal of a revoked session to be refused, got %v", err)
+	}
+
+	// once its first TTL ran out the token is gone
+	sess, err := getSession(context.Background(), s, "somebody", sessions[0]["id"].(string))
+	if err != nil || sess == nil {
+		t.Fatalf("session is missing: %v", err)
+	}
+	sess.TokenExpireTime = 1
+	if err := putSession(context.Background(), s, sess); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = testRequest(b, s, logical.UpdateOperation, "key/somebody/revoke-sessions", nil)
+	if err != nil || resp.IsError() || resp.Data["unrevoked"] != 0 {
+		t.Errorf("expected revocation to succeed, got %v %v", resp, err)
+	}
+}
+
+func TestPruneSessionsOfNestedKeys(t *testing.T) {
+	b, s := testBackend(t)
+	ctx := context.Background()
+	for _, sess := range []*keySession{
+		{ID: "expired", KeyName: "team/somebody", ExpireTime: 1},
+		{ID: "revoked", KeyName: "team/somebody", Revoked: true, TokenExpireTime: 1},
+		{ID: "live", KeyName: "team/somebody", TokenExpireTime: 1},
+	} {
+		if err := putSession(ctx, s, sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.pruneSessions(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := listSessions(ctx, s, "team/somebody")
+	if err != nil || len(sessions) != 1 || sessions[0].ID != "live" {
+		t.Errorf("unexpected sessions after pruning %+v %v", sessions, err)
+	}
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	b, s := testBackend(t)
+	revoker := &fakeRevoker{}
+	b.newRevoker = func(conf *emergencyOTPConfig) (tokenRevoker, error) {
+		return revoker, nil
+	}
+
+	if _, err := testRequest(b, s, logical.UpdateOperation, "revoke-sessions", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(revoker.prefixes) != 1 || revoker.prefixes[0] != "auth/emerg-yubiotp/login" {
+		t.Errorf("unexpected prefix revocations %v", revoker.prefixes)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	// keys without hash preferences are signed with RIPEMD-160
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+var pgpConfig = &packet.Config{DefaultHash: crypto.SHA256}
+
+// name of pgpConfig.DefaultHash in the micalg parameter of PGP/MIME
+const pgpMicAlg = "pgp-sha256"
+
+func readArmoredEntity(armored string) (*openpgp.Entity, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) != 1 {
+		return nil, fmt.Errorf("expected a single key, got %d", len(entities))
+	}
+	return entities[0], nil
+}
+
+// readPGPPublicKey parses the armored public key of a recipient, it must be able to encrypt.
+func readPGPPublicKey(armored string) (*openpgp.Entity, error) {
+	entity, err := readArmoredEntity(armored)
+	if err != nil {
+		return nil, err
+	}
+	w, err := openpgp.Encrypt(io.Discard, []*openpgp.Entity{entity}, nil, nil, pgpConfig)
+	if err != nil {
+		return nil, err
+	}
+	return entity, w.Close()
+}
+
+// readPGPSigningKey parses an armored private key, it must be able to sign without a passphrase.
+func readPGPSigningKey(armored string) (*openpgp.Entity, error) {
+	entity, err := readArmoredEntity(armored)
+	if err != nil {
+		return nil, err
+	}
+	if entity.PrivateKey == nil {
+		return nil, errors.New("not a private key")
+	}
+	if entity.PrivateKey.Encrypted {
+		return nil, errors.New("the private key is protected by a passphrase")
+	}
+	if err := openpgp.DetachSign(io.Discard, entity, strings.NewReader(""), pgpConfig); err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+func pgpFingerprint(entity *openpgp.Entity) string {
+	return strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:]))
+}
+
+// armoredPublicKey exports the public part of a key, e.g. for recipients to verify signatures.
+func armoredPublicKey(entity *openpgp.Entity) (string, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := entity.Serialize(w); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// pgpHasIdentity tells whether a user ID of the key carries the email address.
+func pgpHasIdentity(entity *openpgp.Entity, address string) bool {
+	for _, id := range entity.Identities {
+		if id.UserId != nil && strings.EqualFold(id.UserId.Email, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func pgpDetachSign(signer *openpgp.Entity, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&buf, signer, bytes.NewReader(data), pgpConfig); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pgpEncrypt encrypts data to the recipient and signs it with signer if it is not nil.
+func pgpEncrypt(to *openpgp.Entity, signer *openpgp.Entity, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	aw, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	w, err := openpgp.Encrypt(aw, []*openpgp.Entity{to}, signer, nil, pgpConfig)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func testPGPKey(t *testing.T, name string, email string) (entity *openpgp.Entity, public string, private string) {
+	entity, err := openpgp.NewEntity(name, "", email, &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, _ := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	private = buf.String()
+	if public, err = armoredPublicKey(entity); err != nil {
+		t.Fatal(err)
+	}
+	return entity, public, private
+}
+
+func testEmailParts(t *testing.T, email *outgoingEmail) (*mail.Message, string, [][]byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(email.raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	// split by hand, signatures cover the parts with their headers
+	var parts [][]byte
+	for _, p := range bytes.Split(body, []byte("--"+params["boundary"]))[1:] {
+		if bytes.HasPrefix(p, []byte("--")) {
+			break
+		}
+		p = bytes.TrimPrefix(p, []byte("\r\n"))
+		parts = append(parts, bytes.TrimSuffix(p, []byte("\r\n")))
+	}
+	return msg, mediaType, parts
+}
+
+func TestPGPEmails(t *testing.T) {
+	b, s := testBackend(t)
+	signer, signerPublic, signerPrivate := testPGPKey(t, "Vault", "vault@example.com")
+	alice, alicePublic, _ := testPGPKey(t, "Alice", "alice@example.com")
+
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "config", map[string]interface{}{
+		"email_signing_key": alicePublic,
+	}); err != nil || !resp.IsError() {
+		t.Errorf("expected a public signing key to be rejected, got %v %v", resp, err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "config", map[string]interface{}{
+		"email_signing_key": signerPrivate,
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to write signing key: %v %v", resp, err)
+	}
+	resp, err := testRequest(b, s, logical.ReadOperation, "config", nil)
+	if err != nil || resp.Data["email_signing_key"] != "********" || resp.Data["email_signing_public_key"] != signerPublic ||
+		resp.Data["email_signing_fingerprint"] != pgpFingerprint(signer) {
+		t.Errorf("unexpected config %v %v", resp, err)
+	}
+
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "recipient/Alice@example.com", map[string]interface{}{
+		"pgp_public_key": alicePublic,
+	}); err != nil || resp != nil {
+		t.Fatalf("failed to write recipient: %v %v", resp, err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "recipient/bob@example.com", map[string]interface{}{
+		"pgp_public_key": alicePublic,
+	}); err != nil || resp == nil || len(resp.Warnings) != 1 {
+		t.Errorf("expected a warning about the user ID, got %v %v", resp, err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "recipient/carol@example.com", map[string]interface{}{
+		"pgp_public_key": "not a key",
+	}); err != nil || !resp.IsError() {
+		t.Errorf("expected a broken key to be rejected, got %v %v", resp, err)
+	}
+	if _, err := testRequest(b, s, logical.DeleteOperation, "recipient/bob@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := b.config(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.SMTPFrom = "vault@example.com"
+	e := &emailNotifier{conf: conf, s: s, to: []string{"Alice <alice@example.com>", "bob@example.com"}}
+	emails, err := e.compose(context.Background(), &notification{
+		Event: eventLogin, KeyName: "somebody", RemoteAddr: "192.0.2.1", MountPoint: "auth/emerg-yubiotp/",
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 2 || len(emails[0].rcpt) != 1 || emails[0].rcpt[0] != "alice@example.com" ||
+		len(emails[1].rcpt) != 1 || emails[1].rcpt[0] != "bob@example.com" {
+		t.Fatalf("unexpected emails %+v", emails)
+	}
+	keyring := openpgp.EntityList{alice, signer}
+
+	// alice gets an encrypted and signed email
+	msg, mediaType, parts := testEmailParts(t, emails[0])
+	if mediaType != "multipart/encrypted" || msg.Header.Get("Subject") != encryptedEmailSubject || len(parts) != 2 {
+		t.Fatalf("unexpected encrypted email %s", emails[0].raw)
+	}
+	block, err := armor.Decode(bytes.NewReader(parts[1][bytes.Index(parts[1], []byte("-----BEGIN")):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(md.UnverifiedBody)
+	if md.SignedBy == nil || md.SignatureError != nil {
+		t.Errorf("bad signature of encrypted email: %v", md.SignatureError)
+	}
+	if !bytes.Contains(content, []byte("Subject: Emergency OTP Key 'somebody' was used to log in to Vault")) ||
+		!bytes.Contains(content, []byte("auth/emerg-yubiotp/key/somebody")) {
+		t.Errorf("unexpected encrypted content %s", content)
+	}
+
+	// bob gets a signed email
+	msg, mediaType, parts = testEmailParts(t, emails[1])
+	if mediaType != "multipart/signed" || !strings.Contains(msg.Header.Get("Subject"), "somebody") || len(parts) != 2 {
+		t.Fatalf("unexpected signed email %s", emails[1].raw)
+	}
+	signature := parts[1][bytes.Index(parts[1], []byte("-----BEGIN")):]
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(parts[0]), bytes.NewReader(signature), nil); err != nil {
+		t.Errorf("bad signature: %v", err)
+	}
+	signed, err := mail.ReadMessage(bytes.NewReader(parts[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, _ := mime.ParseMediaType(signed.Header.Get("Content-Type"))
+	text, err := multipart.NewReader(signed.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(text); !bytes.Contains(body, []byte("was used to log in to Vault from 192.0.2.1")) {
+		t.Errorf("unexpected text part %s", body)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// time zones of quiet hours must not depend on the zoneinfo of the host
+	_ "time/tzdata"
+)
+
+// quietHours is a daily period a recipient does not want to be woken up in, like 22:00-07:00.
+type quietHours struct {
+	// minutes after midnight, end is before start if the period spans midnight
+	start int
+	end   int
+	loc   *time.Location
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, must be like 07:30", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseQuietHours reads a period like 22:00-07:00 in an IANA time zone, UTC if zone is empty.
+// It returns nil if spec is empty.
+func parseQuietHours(spec string, zone string) (*quietHours, error) {
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", zone, err)
+	}
+	if spec == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid quiet hours %q, must be like 22:00-07:00", spec)
+	}
+	q := &quietHours{loc: loc}
+	if q.start, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if q.end, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	if q.start == q.end {
+		return nil, fmt.Errorf("quiet hours %q are empty", spec)
+	}
+	return q, nil
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+	t = t.In(q.loc)
+	minute := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// isQuiet tells whether t is in the quiet hours, settings that do not parse are never quiet.
+func isQuiet(spec string, zone string, t time.Time) bool {
+	q, err := parseQuietHours(spec, zone)
+	return err == nil && q != nil && q.contains(t)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// reminders before a key becomes eligible if the mount config has none, in seconds
+var defaultReminders = []int64{6 * 60 * 60, 60 * 60}
+
+// reminders returns the reminder times of the mount, largest first.
+func (c *emergencyOTPConfig) reminders() []int64 {
+	if c.Reminders == nil {
+		return defaultReminders
+	}
+	return c.Reminders
+}
+
+// parseReminders reads durations like 6h or 3600, an empty list turns reminders off.
+func parseReminders(values []string) ([]int64, error) {
+	reminders := []int64{}
+	for _, v := range values {
+		d, err := parseutil.ParseDurationSecond(v)
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Minute {
+			return nil, errors.New("reminders must be at least a minute before eligibility")
+		}
+		seconds := int64(d / time.Second)
+		if !containsInt64(reminders, seconds) {
+			reminders = append(reminders, seconds)
+		}
+	}
+	sort.Slice(reminders, func(i, j int) bool { return reminders[i] > reminders[j] })
+	return reminders, nil
+}
+
+func containsInt64(list []int64, v int64) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// keyReminder is how far the lifecycle notifications of a waiting key got. Only periodic writes it,
+// so it lives apart from the key.
+type keyReminder struct {
+	// NextEligibleTime of the key the notifications are for
+	EligibleTime int64 `json:"eligible_time"`
+	// seconds before EligibleTime up to which notifications went out, 0 once the key is eligible
+	Offset int64 `json:"offset"`
+}
+
+func getKeyReminder(ctx context.Context, s logical.Storage, keyName string) (*keyReminder, error) {
+	entry, err := s.Get(ctx, "reminder/"+keyName)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var r keyReminder
+	if err := entry.DecodeJSON(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func putKeyReminder(ctx context.Context, s logical.Storage, keyName string, r *keyReminder) error {
+	entry, err := logical.StorageEntryJSON("reminder/"+keyName, r)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// next returns the event due for a key eligible at eligibleTime, empty if there is none, and moves the
+// reminder past it. Of several reminders that are due only the last one is sent.
+func (r *keyReminder) next(reminders []int64, eligibleTime int64, now time.Time) string {
+	remaining := eligibleTime - now.Unix()
+	if r.EligibleTime != eligibleTime {
+		// a new activation or a changed timer, the activation notification covers the reminders that
+		// already passed but not the eligibility, e.g. if an operator granted access right away
+		r.EligibleTime = eligibleTime
+		r.Offset = remaining
+		if remaining < 0 {
+			r.Offset = 0
+			return eventEligible
+		}
+		return ""
+	}
+	if remaining < 0 {
+		if r.Offset > 0 {
+			r.Offset = 0
+			return eventEligible
+		}
+		return ""
+	}
+	due := int64(-1)
+	for _, offset := range reminders {
+		if remaining <= offset && offset < r.Offset {
+			due = offset
+		}
+	}
+	if due < 0 {
+		return ""
+	}
+	r.Offset = due
+	return eventReminder
+}
+
+// remindKeys tells about keys that will soon be, or just became, eligible.
+func (b *backend) remindKeys(ctx context.Context, s logical.Storage, now time.Time) error {
+	names, err := listRecursive(ctx, s, "key/")
+	if err != nil {
+		return err
+	}
+	conf, err := b.config(ctx, s)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		key, err := b.key(ctx, s, name)
+		if err != nil {
+			return err
+		}
+		r, err := getKeyReminder(ctx, s, name)
+		if err != nil {
+			return err
+		}
+		if key == nil || key.NextEligibleTime <= 0 || key.eligibilityExpired(now) {
+			if r != nil {
+				if err := s.Delete(ctx, "reminder/"+name); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if r == nil {
+			r = &keyReminder{}
+		}
+		prev := *r
+		event := r.next(conf.reminders(), key.NextEligibleTime, now)
+		if *r != prev {
+			if err := putKeyReminder(ctx, s, name, r); err != nil {
+				return err
+			}
+		}
+		if event == "" {
+			continue
+		}
+		var ar *activationRequest
+		if key.ActiveRequest != "" {
+			if ar, err = getActivationRequest(ctx, s, key.ActiveRequest); err != nil {
+				return err
+			}
+		}
+		// the login notification told already
+		if event == eventEligible && ar != nil && ar.State == requestStateConsumed {
+			continue
+		}
+
+		n := &notification{
+			Event:            event,
+			Time:             now.Unix(),
+			KeyName:          key.Name,
+			KeyAlias:         key.Alias,
+			PublicID:         key.PublicID,
+			EntityID:         key.EntityID,
+			Delay:            key.Delay,
+			DelayMail:        key.DelayMail,
+			NextEligibleTime: key.NextEligibleTime,
+			RequestID:        key.ActiveRequest,
+		}
+		if ar != nil {
+			n.MountPoint = ar.MountPoint
+			n.RemoteAddr = ar.RemoteAddr
+		}
+		// failures are logged by notify and retried from the outbox
+		if _, err := b.notify(ctx, s, n); err != nil {
+			b.Logger().Error("failed to send reminder", "key", key.Name, "event", event, "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestReminderConfig(t *testing.T) {
+	b, s := testBackend(t)
+	resp, err := testRequest(b, s, logical.ReadOperation, "config", nil)
+	if err != nil || !reflect.DeepEqual(resp.Data["reminders"], defaultReminders) {
+		t.Errorf("unexpected default reminders %v %v", resp, err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "config", map[string]interface{}{"reminders": "10s"}); err != nil || !resp.IsError() {
+		t.Errorf("expected too short reminder to be rejected, got %v %v", resp, err)
+	}
+	for value, expected := range map[string][]int64{
+		"30m,2h,7200": {7200, 1800},
+		"":            {},
+	} {
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "config", map[string]interface{}{"reminders": value}); err != nil || resp.IsError() {
+			t.Fatalf("failed to write reminders %q: %v %v", value, resp, err)
+		}
+		resp, err := testRequest(b, s, logical.ReadOperation, "config", nil)
+		if err != nil || !reflect.DeepEqual(resp.Data["reminders"], expected) {
+			t.Errorf("unexpected reminders for %q: %v %v", value, resp.Data["reminders"], err)
+		}
+	}
+}
+
+func TestRemindKeys(t *testing.T) {
+	b, s := testBackend(t)
+	ctx := context.Background()
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/oncall", map[string]interface{}{
+		"type": "memory", "box": t.Name(), "events": "reminder,eligible",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "key/team/somebody", map[string]interface{}{
+		"public_id":          testPublicID,
+		"next_eligible_time": "+8h",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to write key: %v %v", resp, err)
+	}
+
+	now := time.Now()
+	for _, step := range []struct {
+		after time.Duration
+		event string
+	}{
+		// the first sweep only takes note of the timer
+		{0, ""},
+		{2*time.Hour + time.Minute, eventReminder},
+		{2*time.Hour + 2*time.Minute, ""},
+		{7*time.Hour + 30*time.Minute, eventReminder},
+		{8*time.Hour + time.Minute, eventEligible},
+		{8*time.Hour + 2*time.Minute, ""},
+	} {
+		if err := b.remindKeys(ctx, s, now.Add(step.after)); err != nil {
+			t.Fatal(err)
+		}
+		sent := testNotifier.take(t.Name())
+		if step.event == "" && len(sent) != 0 || step.event != "" && (len(sent) != 1 || sent[0].Event != step.event || sent[0].KeyName != "team/somebody") {
+			t.Errorf("unexpected notifications after %v: %+v", step.after, sent)
+		}
+	}
+
+	// after a missed sweep only the last reminder due goes out
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "key/team/somebody", map[string]interface{}{
+		"public_id":          testPublicID,
+		"next_eligible_time": "+3h",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to write key: %v %v", resp, err)
+	}
+	if err := b.remindKeys(ctx, s, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.remindKeys(ctx, s, now.Add(2*time.Hour+30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	sent := testNotifier.take(t.Name())
+	if len(sent) != 1 || sent[0].title() != "Emergency OTP Key 'team/somebody' becomes eligible on Vault in 30m" {
+		t.Errorf("unexpected notifications %+v", sent)
+	}
+}
+
+func TestEligibleNotifiedOnce(t *testing.T) {
+	b, s := testBackend(t)
+	ctx := context.Background()
+	verifier := newMemoryVerifier()
+	b.verifier = verifier
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/oncall", map[string]interface{}{
+		"type": "memory", "box": t.Name(), "events": "request,eligible",
+	}); err != nil || resp.IsError() {
+		t.Fatalf("failed to create channel: %v %v", resp, err)
+	}
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"public_id": testPublicID,
+		"delay":     60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := testPendingRequest(t, b, s, verifier, 1)
+	testNotifier.take(t.Name())
+
+	// granted before the sweep saw the timer, the request and the key become eligible together
+	if _, err := testRequest(b, s, logical.UpdateOperation, "key/somebody", map[string]interface{}{
+		"next_eligible_time": "1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := b.advanceRequests(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.remindKeys(ctx, s, now.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent := testNotifier.take(t.Name()); len(sent) != 1 || sent[0].Event != eventEligible || sent[0].RequestID != id {
+		t.Errorf("expected one eligible notification, got %+v", sent)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// tokenRevoker revokes tokens issued by this mount.
+// The system view of this SDK offers no way for a plugin to revoke tokens, so this goes through the Vault API
+// with a token that may only revoke accessors, and revoke the leases of the mount for revoke-sessions.
+type tokenRevoker interface {
+	RevokeAccessor(ctx context.Context, accessor string) error
+	// RevokePrefix revokes every lease under the prefix, e.g. auth/emerg-yubiotp/login
+	RevokePrefix(ctx context.Context, prefix string) error
+}
+
+// apiTokenRevoker talks to Vault with the revocation token from the config.
+type apiTokenRevoker struct {
+	client *api.Client
+}
+
+func newAPITokenRevoker(conf *emergencyOTPConfig) (tokenRevoker, error) {
+	if conf.RevocationToken == "" {
+		return nil, errors.New("revocation_token is not configured")
+	}
+	apiConf := api.DefaultConfig()
+	if apiConf.Error != nil {
+		return nil, apiConf.Error
+	}
+	if conf.RevocationVaultAddr != "" {
+		apiConf.Address = conf.RevocationVaultAddr
+	}
+	if conf.RevocationCABundle != "" {
+		if err := apiConf.ConfigureTLS(&api.TLSConfig{CACertBytes: []byte(conf.RevocationCABundle)}); err != nil {
+			return nil, err
+		}
+	}
+	client, err := api.NewClient(apiConf)
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(conf.RevocationToken)
+	return &apiTokenRevoker{client: client}, nil
+}
+
+func (r *apiTokenRevoker) RevokeAccessor(ctx context.Context, accessor string) error {
+	_, err := r.client.Logical().WriteWithContext(ctx, "auth/token/revoke-accessor", map[string]interface{}{
+		"accessor": accessor,
+	})
+	// already expired or revoked
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == 400 && strings.Contains(respErr.Error(), "invalid accessor") {
+		return nil
+	}
+	return err
+}
+
+func (r *apiTokenRevoker) RevokePrefix(ctx context.Context, prefix string) error {
+	return r.client.Sys().RevokePrefixWithContext(ctx, prefix)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// number of security events kept on a key, oldest are dropped first
+const maxSecurityEvents = 20
+
+const (
+	securityEventReplayedOTP   = "replayed_otp"
+	securityEventPossibleClone = "possible_clone"
+	securityEventBadSignature  = "bad_signature"
+	securityEventUnknownKey    = "unknown_key"
+)
+
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// securityEventDescriptions explain each event type to the people notified.
+var securityEventDescriptions = map[string]string{
+	securityEventReplayedOTP: "An OTP of this key was presented that has been used before. " +
+		"Somebody may have phished an OTP from the key holder and is trying to use it.",
+	securityEventPossibleClone: "The OTP counters of this key moved in an unexpected way. " +
+		"The key secret may have been copied to another device.",
+	securityEventBadSignature: "The answer of the validation server could not be authenticated. " +
+		"Somebody may be intercepting the connection between Vault and the validation server.",
+	securityEventUnknownKey: "A valid OTP of a YubiKey that is not enrolled was presented. " +
+		"Somebody may be probing the emergency login.",
+}
+
+// verifyOutcome classifies a validation status.
+type verifyOutcome struct {
+	// security event recorded against the key, empty if the status is not suspicious
+	Event    string
+	Severity string
+	// whether notifications are sent for the event
+	Notify bool
+	// counted on the key in badOTPCount instead of recorded as an event
+	Counted bool
+	// shown to the user logging in
+	Message string
+}
+
+var verifyOutcomes = map[string]verifyOutcome{
+	otpStatusBadOTP: {
+		Severity: severityWarning,
+		Counted:  true,
+		Message:  "the OTP is invalid",
+	},
+	otpStatusReplayedOTP: {
+		Event:    securityEventReplayedOTP,
+		Severity: severityCritical,
+		Notify:   true,
+		Message:  "the OTP was used before",
+	},
+	otpStatusBadSignature: {
+		Event:    securityEventBadSignature,
+		Severity: severityCritical,
+		Notify:   true,
+		Message:  "the validation server answer could not be authenticated",
+	},
+	otpStatusMissingParameter: {
+		Severity: severityWarning,
+		Message:  "the validation request was malformed",
+	},
+	otpStatusNoSuchClient: {
+		Severity: severityWarning,
+		Message:  "the validation client is misconfigured",
+	},
+	otpStatusOperationNotAllowed: {
+		Severity: severityWarning,
+		Message:  "the validation client is misconfigured",
+	},
+	otpStatusBackendError: {
+		Severity: severityInfo,
+		Message:  "the validation server is unavailable",
+	},
+	otpStatusNotEnoughAnswers: {
+		Severity: severityInfo,
+		Message:  "the validation server is unavailable",
+	},
+	otpStatusReplayedRequest: {
+		Severity: severityInfo,
+		Message:  "the validation server is unavailable",
+	},
+}
+
+func verifyOutcomeFor(status string) verifyOutcome {
+	if outcome, ok := verifyOutcomes[status]; ok {
+		return outcome
+	}
+	return verifyOutcome{
+		Severity: severityWarning,
+		Message:  "unknown validation status " + status,
+	}
+}
+
+// securityEvent is something suspicious observed about a key.
+type securityEvent struct {
+	Type       string `json:"type"`
+	Severity   string `json:"severity"`
+	Time       int64  `json:"time"`
+	PublicID   string `json:"public_id"`
+	RemoteAddr string `json:"remote_addr"`
+	Detail     string `json:"detail"`
+}
+
+func newSecurityEvent(req *logical.Request, eventType string, severity string, detail string) securityEvent {
+	ev := securityEvent{
+		Type:     eventType,
+		Severity: severity,
+		Time:     time.Now().Unix(),
+		Detail:   detail,
+	}
+	if req.Connection != nil {
+		ev.RemoteAddr = req.Connection.RemoteAddr
+	}
+	return ev
+}
+
+// badOTPCount sums up the invalid OTPs presented for a key. Anybody who knows the public ID can cause
+// them, so they are not security events that could push replays and clones out of the key.
+type badOTPCount struct {
+	Count          int64  `json:"count"`
+	FirstTime      int64  `json:"first_time"`
+	LastTime       int64  `json:"last_time"`
+	LastRemoteAddr string `json:"last_remote_addr"`
+}
+
+func (k *keyState) countBadOTP(req *logical.Request, now time.Time) {
+	if k.BadOTPs.Count == 0 {
+		k.BadOTPs.FirstTime = now.Unix()
+	}
+	k.BadOTPs.Count++
+	k.BadOTPs.LastTime = now.Unix()
+	k.BadOTPs.LastRemoteAddr = ""
+	if req.Connection != nil {
+		k.BadOTPs.LastRemoteAddr = req.Connection.RemoteAddr
+	}
+}
+
+func (k *keyState) recordSecurityEvent(ev securityEvent) {
+	k.SecurityEvents = append(k.SecurityEvents, ev)
+	if len(k.SecurityEvents) > maxSecurityEvents {
+		k.SecurityEvents = k.SecurityEvents[len(k.SecurityEvents)-maxSecurityEvents:]
+	}
+}
+
+// reportSecurityEvent records the event on the key and notifies about it if asked to.
+// key is nil if the public ID is not on file, then the event is only logged and notified.
+// Delivery failures are only logged, the caller is responsible for persisting the key.
+func (b *backend) reportSecurityEvent(ctx context.Context, req *logical.Request, key *keyState, ev securityEvent, notify bool) {
+	keyName := ""
+	if key != nil {
+		keyName = key.Name
+		if ev.PublicID == "" {
+			ev.PublicID = key.PublicID
+		}
+		key.recordSecurityEvent(ev)
+	}
+	b.Logger().Warn("security event", "key", keyName, "public_id", ev.PublicID, "type", ev.Type, "severity", ev.Severity,
+		"remote_addr", ev.RemoteAddr, "detail", ev.Detail)
+	if !notify {
+		return
+	}
+	n := newNotification(req, eventSecurity, key)
+	n.PublicID = ev.PublicID
+	n.Security = &ev
+	if _, err := b.notify(ctx, req.Storage, n); err != nil {
+		b.Logger().Error("failed to send security notification", "key", keyName, "error", err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+)
+
+const (
+	// TLS from the first byte, usually port 465
+	smtpTLSImplicit = "implicit"
+	// STARTTLS is required, usually port 587
+	smtpTLSStartTLS = "starttls"
+	// plaintext, for relays on a trusted network
+	smtpTLSNone = "none"
+)
+
+var smtpTLSModes = []string{smtpTLSImplicit, smtpTLSStartTLS, smtpTLSNone}
+
+var smtpAuthMechanisms = []string{"plain", "login", "cram-md5"}
+
+const defaultSMTPTimeout = 10 * time.Second
+
+// smtpTransport talks to the SMTP server of the mount config.
+type smtpTransport struct {
+	host      string
+	port      int
+	tlsMode   string
+	tlsConfig *tls.Config
+	auth      string
+	username  string
+	password  string
+	helo      string
+	timeout   time.Duration
+}
+
+// newSMTPTransport checks the SMTP settings of a config. Without smtp_tls_mode, TLS is implicit on port 465
+// and STARTTLS is used if the server offers it on other ports.
+func newSMTPTransport(conf *emergencyOTPConfig) (*smtpTransport, error) {
+	if conf.SMTPHost == "" {
+		return nil, errors.New("smtp_host is not configured")
+	}
+	t := &smtpTransport{
+		host:     conf.SMTPHost,
+		port:     conf.SMTPPort,
+		tlsMode:  conf.SMTPTLSMode,
+		auth:     conf.SMTPAuth,
+		username: conf.SMTPUsername,
+		password: conf.SMTPPassword,
+		helo:     conf.SMTPHelo,
+		timeout:  time.Duration(conf.SMTPTimeout) * time.Second,
+	}
+	if t.tlsMode != "" && !strutil.StrListContains(smtpTLSModes, t.tlsMode) {
+		return nil, fmt.Errorf("invalid smtp_tls_mode %q, must be one of %s", t.tlsMode, strings.Join(smtpTLSModes, ", "))
+	}
+	if t.tlsMode == "" && t.port == 465 {
+		t.tlsMode = smtpTLSImplicit
+	}
+	if t.port == 0 {
+		switch t.tlsMode {
+		case smtpTLSImplicit:
+			t.port = 465
+		case smtpTLSNone:
+			t.port = 25
+		default:
+			t.port = 587
+		}
+	}
+	if t.auth != "" && !strutil.StrListContains(smtpAuthMechanisms, t.auth) {
+		return nil, fmt.Errorf("invalid smtp_auth %q, must be one of %s", t.auth, strings.Join(smtpAuthMechanisms, ", "))
+	}
+	if t.auth != "" && t.username == "" {
+		return nil, errors.New("smtp_auth needs smtp_username")
+	}
+	if t.timeout <= 0 {
+		t.timeout = defaultSMTPTimeout
+	}
+
+	t.tlsConfig = &tls.Config{
+		ServerName: conf.SMTPServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if t.tlsConfig.ServerName == "" {
+		t.tlsConfig.ServerName = t.host
+	}
+	if conf.SMTPCABundle != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(conf.SMTPCABundle)) {
+			return nil, errors.New("smtp_ca_bundle contains no PEM certificate")
+		}
+		t.tlsConfig.RootCAs = pool
+	}
+	return t, nil
+}
+
+// dial connects, says hello, sets up TLS and authenticates.
+func (t *smtpTransport) dial() (*smtp.Client, net.Conn, error) {
+	addr := net.JoinHostPort(t.host, strconv.Itoa(t.port))
+	dialer := &net.Dialer{Timeout: t.timeout}
+	var conn net.Conn
+	var err error
+	if t.tlsMode == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, t.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(t.timeout))
+
+	c, err := smtp.NewClient(conn, t.host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := t.setup(c); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, conn, nil
+}
+
+func (t *smtpTransport) setup(c *smtp.Client) error {
+	if t.helo != "" {
+		if err := c.Hello(t.helo); err != nil {
+			return err
+		}
+	}
+	if t.tlsMode != smtpTLSImplicit && t.tlsMode != smtpTLSNone {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(t.tlsConfig); err != nil {
+				return err
+			}
+		} else if t.tlsMode == smtpTLSStartTLS {
+			return errors.New("the SMTP server does not offer STARTTLS")
+		}
+	}
+	if t.username == "" {
+		return nil
+	}
+	ok, mechanisms := c.Extension("AUTH")
+	if !ok {
+		return errors.New("the SMTP server does not offer authentication")
+	}
+	return c.Auth(t.smtpAuth(strings.Fields(strings.ToLower(mechanisms))))
+}
+
+// smtpAuth picks the configured mechanism, or the best one the server offers.
+func (t *smtpTransport) smtpAuth(offered []string) smtp.Auth {
+	mechanism := t.auth
+	if mechanism == "" {
+		mechanism = "plain"
+		if strutil.StrListContains(offered, "cram-md5") {
+			mechanism = "cram-md5"
+		} else if strutil.StrListContains(offered, "login") && !strutil.StrListContains(offered, "plain") {
+			mechanism = "login"
+		}
+	}
+	switch mechanism {
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(t.username, t.password)
+	case "login":
+		return &smtpLoginAuth{host: t.host, username: t.username, password: t.password}
+	default:
+		return smtp.PlainAuth("", t.username, t.password, t.host)
+	}
+}
+
+// check connects to the server and logs in without sending anything.
+func (t *smtpTransport) check() error {
+	c, _, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Quit()
+}
+
+func (t *smtpTransport) send(from string, emails []*outgoingEmail) error {
+	c, conn, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for _, email := range emails {
+		conn.SetDeadline(time.Now().Add(t.timeout))
+		if err := c.Mail(from); err != nil {
+			return err
+		}
+		for _, rcpt := range email.rcpt {
+			if err := c.Rcpt(rcpt); err != nil {
+				return err
+			}
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(email.raw); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return c.Quit()
+}
+
+// smtpLoginAuth is the LOGIN mechanism, which net/smtp lacks. Like PLAIN it needs TLS unless the server is local.
+type smtpLoginAuth struct {
+	host     string
+	username string
+	password string
+}
+
+func (a *smtpLoginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && a.host != "localhost" && !net.ParseIP(a.host).IsLoopback() {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *smtpLoginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// testSMTPServer is just enough of an SMTP server for the client in smtp.go.
+type testSMTPServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	implicit bool
+	starttls bool
+	caBundle string
+
+	mu    sync.Mutex
+	helo  []string
+	auth  []string
+	mails []testSMTPMail
+}
+
+type testSMTPMail struct {
+	tls  bool
+	from string
+	rcpt []string
+	data string
+}
+
+// newTestSMTPServer serves with the certificate of httptest, valid for example.com and 127.0.0.1.
+func newTestSMTPServer(t *testing.T, implicit bool, starttls bool) *testSMTPServer {
+	certs := httptest.NewTLSServer(nil)
+	certs.Close()
+	srv := &testSMTPServer{
+		tls:      &tls.Config{Certificates: certs.TLS.Certificates},
+		implicit: implicit,
+		starttls: starttls,
+		caBundle: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs.Certificate().Raw})),
+	}
+	var err error
+	if srv.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.listener.Close() })
+	go func() {
+		for {
+			conn, err := srv.listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *testSMTPServer) port() int {
+	return srv.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (srv *testSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	secure := false
+	if srv.implicit {
+		conn = tls.Server(conn, srv.tls)
+		secure = true
+	}
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+	var mail testSMTPMail
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			srv.mu.Lock()
+			srv.helo = append(srv.helo, arg)
+			srv.mu.Unlock()
+			lines := []string{"localhost"}
+			if srv.starttls && !secure {
+				lines = append(lines, "STARTTLS")
+			}
+			lines = append(lines, "AUTH PLAIN LOGIN CRAM-MD5")
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				text.PrintfLine("250%s%s", sep, l)
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 go ahead")
+			conn = tls.Server(conn, srv.tls)
+			text = textproto.NewConn(conn)
+			secure = true
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			switch mechanism {
+			case "PLAIN":
+				decoded, _ := base64.StdEncoding.DecodeString(initial)
+				srv.record("PLAIN " + strings.ReplaceAll(string(decoded), "\x00", " "))
+			case "LOGIN":
+				text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+				user, _ := text.ReadLine()
+				text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+				pass, _ := text.ReadLine()
+				u, _ := base64.StdEncoding.DecodeString(user)
+				p, _ := base64.StdEncoding.DecodeString(pass)
+				srv.record("LOGIN " + string(u) + " " + string(p))
+			case "CRAM-MD5":
+				text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("<1.1@localhost>")))
+				resp, _ := text.ReadLine()
+				decoded, _ := base64.StdEncoding.DecodeString(resp)
+				user, _, _ := strings.Cut(string(decoded), " ")
+				srv.record("CRAM-MD5 " + user)
+			}
+			text.PrintfLine("235 ok")
+		case "MAIL":
+			mail = testSMTPMail{tls: secure, from: strings.TrimSuffix(strings.TrimPrefix(arg, "FROM:<"), ">")}
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			mail.rcpt = append(mail.rcpt, strings.TrimSuffix(strings.TrimPrefix(arg, "TO:<"), ">"))
+			text.PrintfLine("250 ok")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			data, _ := text.ReadDotBytes()
+			mail.data = string(data)
+			srv.mu.Lock()
+			srv.mails = append(srv.mails, mail)
+			srv.mu.Unlock()
+			text.PrintfLine("250 ok")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (srv *testSMTPServer) record(auth string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.auth = append(srv.auth, auth)
+}
+
+func TestSMTPTransport(t *testing.T) {
+	starttls := newTestSMTPServer(t, false, true)
+	implicit := newTestSMTPServer(t, true, false)
+	plain := newTestSMTPServer(t, false, false)
+
+	for _, tc := range []struct {
+		name string
+		srv  *testSMTPServer
+		conf emergencyOTPConfig
+		auth string
+		tls  bool
+	}{
+		{
+			name: "starttls with login",
+			srv:  starttls,
+			conf: emergencyOTPConfig{SMTPTLSMode: smtpTLSStartTLS, SMTPServerName: "example.com", SMTPAuth: "login",
+				SMTPUsername: "vault", SMTPPassword: "hunter2", SMTPHelo: "vault.example.com"},
+			auth: "LOGIN vault hunter2",
+			tls:  true,
+		},
+		{
+			name: "implicit tls with plain",
+			srv:  implicit,
+			conf: emergencyOTPConfig{SMTPTLSMode: smtpTLSImplicit, SMTPServerName: "example.com", SMTPAuth: "plain",
+				SMTPUsername: "vault", SMTPPassword: "hunter2"},
+			auth: "PLAIN  vault hunter2",
+			tls:  true,
+		},
+		{
+			name: "picked mechanism",
+			srv:  starttls,
+			conf: emergencyOTPConfig{SMTPServerName: "example.com", SMTPUsername: "vault", SMTPPassword: "hunter2"},
+			auth: "CRAM-MD5 vault",
+			tls:  true,
+		},
+		{
+			name: "plaintext relay",
+			srv:  plain,
+			conf: emergencyOTPConfig{SMTPTLSMode: smtpTLSNone},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := tc.conf
+			conf.SMTPHost = "127.0.0.1"
+			conf.SMTPPort = tc.srv.port()
+			conf.SMTPCABundle = tc.srv.caBundle
+			conf.SMTPFrom = "Vault <vault@example.com>"
+			transport, err := newSMTPTransport(&conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.srv.mu.Lock()
+			tc.srv.auth, tc.srv.mails = nil, nil
+			tc.srv.mu.Unlock()
+			if err := transport.send("vault@example.com", []*outgoingEmail{
+				{rcpt: []string{"oncall@example.com", "security@example.com"}, raw: []byte("Subject: test\r\n\r\nhello\r\n")},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			tc.srv.mu.Lock()
+			defer tc.srv.mu.Unlock()
+			if len(tc.srv.mails) != 1 || tc.srv.mails[0].tls != tc.tls || tc.srv.mails[0].from != "vault@example.com" ||
+				strings.Join(tc.srv.mails[0].rcpt, ",") != "oncall@example.com,security@example.com" ||
+				!strings.Contains(tc.srv.mails[0].data, "hello") {
+				t.Errorf("unexpected mails %+v", tc.srv.mails)
+			}
+			if (tc.auth == "" && len(tc.srv.auth) != 0) || (tc.auth != "" && (len(tc.srv.auth) != 1 || tc.srv.auth[0] != tc.auth)) {
+				t.Errorf("unexpected authentication %q", tc.srv.auth)
+			}
+			if conf.SMTPHelo != "" && tc.srv.helo[len(tc.srv.helo)-1] != conf.SMTPHelo {
+				t.Errorf("unexpected HELO %v", tc.srv.helo)
+			}
+		})
+	}
+}
+
+func TestSMTPConfigChecked(t *testing.T) {
+	srv := newTestSMTPServer(t, false, true)
+	b, s := testBackend(t)
+	base := map[string]interface{}{
+		"smtp_host":        "127.0.0.1",
+		"smtp_port":        srv.port(),
+		"smtp_tls_mode":    smtpTLSStartTLS,
+		"smtp_server_name": "example.com",
+		"smtp_timeout":     "2s",
+	}
+	for _, tc := range []struct {
+		data map[string]interface{}
+		ok   bool
+	}{
+		{map[string]interface{}{"smtp_ca_bundle": srv.caBundle}, true},
+		// the system roots do not know the test CA
+		{map[string]interface{}{"smtp_ca_bundle": ""}, false},
+		{map[string]interface{}{"smtp_ca_bundle": srv.caBundle, "smtp_server_name": "vault.example.org"}, false},
+		{map[string]interface{}{"smtp_ca_bundle": srv.caBundle, "smtp_tls_mode": "sometimes"}, false},
+		{map[string]interface{}{"smtp_ca_bundle": srv.caBundle, "smtp_auth": "ntlm", "smtp_username": "vault"}, false},
+		{map[string]interface{}{"smtp_ca_bundle": srv.caBundle, "smtp_auth": "plain", "smtp_username": ""}, false},
+	} {
+		data := make(map[string]interface{})
+		for k, v := range base {
+			data[k] = v
+		}
+		for k, v := range tc.data {
+			data[k] = v
+		}
+		resp, err := testRequest(b, s, logical.UpdateOperation, "config", data)
+		if err != nil || resp.IsError() == tc.ok {
+			t.Errorf("unexpected result for %v: %v %v", tc.data, resp, err)
+		}
+	}
+	resp, err := testRequest(b, s, logical.ReadOperation, "config", nil)
+	if err != nil || resp.Data["smtp_tls_mode"] != smtpTLSStartTLS || resp.Data["smtp_timeout"] != 2 ||
+		resp.Data["smtp_server_name"] != "example.com" {
+		t.Errorf("unexpected config %v %v", resp, err)
+	}
+
+	// nothing listens there anymore
+	srv.listener.Close()
+	start := time.Now()
+	data := map[string]interface{}{"smtp_port": strconv.Itoa(srv.port())}
+	if resp, err := testRequest(b, s, logical.UpdateOperation, "config", data); err != nil || !resp.IsError() {
+		t.Errorf("expected unreachable server to be rejected, got %v %v", resp, err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("smtp_timeout not applied")
+	}
+}
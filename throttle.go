@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// window of channels without a throttle setting
+const defaultNotifyThrottle = 15 * time.Minute
+
+// events caused by login attempts, the others are state changes and never held back
+var throttledEvents = []string{eventActivation, eventLogin, eventSecurity}
+
+// notifyThrottle is what a channel was told about one kind of event of one key.
+type notifyThrottle struct {
+	// RequestID of the last activation notification sent
+	Activation string `json:"activation"`
+	LastSent   int64  `json:"last_sent"`
+	// throttle of the channel in seconds when LastSent
+	Window int64 `json:"window"`
+	// notifications held back since LastSent and the latest of them
+	Suppressed int           `json:"suppressed"`
+	Latest     *notification `json:"latest,omitempty"`
+}
+
+// throttlePath groups notifications by channel, event and key, keys that are not enrolled by public ID.
+// Security events are grouped by their type as well.
+func throttlePath(channel string, n *notification) string {
+	group := n.Event
+	if n.Security != nil {
+		group += "-" + n.Security.Type
+	}
+	if n.KeyName != "" {
+		return "throttle/" + channel + "/" + group + "/key/" + n.KeyName
+	}
+	return "throttle/" + channel + "/" + group + "/public-id/" + n.PublicID
+}
+
+func getNotifyThrottle(ctx context.Context, s logical.Storage, path string) (*notifyThrottle, error) {
+	entry, err := s.Get(ctx, path)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var t notifyThrottle
+	if err := entry.DecodeJSON(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func putNotifyThrottle(ctx context.Context, s logical.Storage, path string, t *notifyThrottle) error {
+	entry, err := logical.StorageEntryJSON(path, t)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// throttle holds n back if the channel got the same kind of notification of the key within its window.
+// The first notification of an activation always goes out. Otherwise n carries the number of
+// notifications held back before it.
+func (b *backend) throttle(ctx context.Context, s logical.Storage, conf *emergencyOTPConfig, c *notifyChannel, n *notification, now time.Time) (bool, error) {
+	window := c.throttle()
+	if window <= 0 || !strutil.StrListContains(throttledEvents, n.Event) {
+		return false, nil
+	}
+	path := throttlePath(c.Name, n)
+	t, err := getNotifyThrottle(ctx, s, path)
+	if err != nil {
+		return false, err
+	}
+	if t == nil {
+		t = &notifyThrottle{}
+	}
+
+	newActivation := n.Event == eventActivation && n.RequestID != t.Activation
+	if !newActivation && now.Unix() < t.LastSent+t.Window {
+		t.Suppressed++
+		t.Latest = n
+		return true, putNotifyThrottle(ctx, s, path, t)
+	}
+	if t.Suppressed > 0 {
+		if newActivation {
+			// the attempts of the previous activation get a follow-up of their own
+			if _, err := b.followUp(ctx, s, conf, c, t, now); err != nil {
+				return false, err
+			}
+		} else {
+			n.FurtherAttempts = t.Suppressed
+		}
+	}
+	t.LastSent = now.Unix()
+	t.Window = int64(window / time.Second)
+	t.Suppressed = 0
+	t.Latest = nil
+	if n.Event == eventActivation {
+		t.Activation = n.RequestID
+	}
+	return false, putNotifyThrottle(ctx, s, path, t)
+}
+
+// followUp sends the latest notification held back with the number of those held back.
+func (b *backend) followUp(ctx context.Context, s logical.Storage, conf *emergencyOTPConfig, c *notifyChannel, t *notifyThrottle, now time.Time) (notifyResult, error) {
+	f := *t.Latest
+	f.FurtherAttempts = t.Suppressed
+	return b.send(ctx, s, conf, c, &f, now)
+}
+
+// flushThrottles sends follow-ups for notifications held back in windows that are over and
+// forgets quiet ones.
+func (b *backend) flushThrottles(ctx context.Context, s logical.Storage, now time.Time) error {
+	paths, err := listRecursive(ctx, s, "throttle/")
+	if err != nil {
+		return err
+	}
+	var conf *emergencyOTPConfig
+	for _, path := range paths {
+		path = "throttle/" + path
+		t, err := getNotifyThrottle(ctx, s, path)
+		if err != nil {
+			return err
+		}
+		if t == nil || now.Unix() < t.LastSent+t.Window {
+			continue
+		}
+		if t.Suppressed == 0 || t.Latest == nil {
+			if err := s.Delete(ctx, path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if conf == nil {
+			if conf, err = b.config(ctx, s); err != nil {
+				return err
+			}
+		}
+		channels, err := b.notifyChannels(ctx, s, conf, t.Latest)
+		if err != nil {
+			return err
+		}
+		name := strings.SplitN(path, "/", 3)[1]
+		var channel *notifyChannel
+		for _, c := range channels {
+			if c.Name == name {
+				channel = c
+				break
+			}
+		}
+		if channel == nil {
+			if err := s.Delete(ctx, path); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := b.followUp(ctx, s, conf, channel, t, now); err != nil {
+			return err
+		}
+		// the follow-up opens a new window
+		t.LastSent = now.Unix()
+		t.Window = int64(channel.throttle() / time.Second)
+		t.Suppressed = 0
+		t.Latest = nil
+		if err := putNotifyThrottle(ctx, s, path, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
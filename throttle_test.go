@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestNotifyThrottle(t *testing.T) {
+	b, s := testBackend(t)
+	ctx := context.Background()
+	for name, data := range map[string]map[string]interface{}{
+		"oncall": {"type": "memory", "box": t.Name() + "-oncall", "events": "activation,security"},
+		"all":    {"type": "memory", "box": t.Name() + "-all", "events": "activation", "throttle": 0},
+	} {
+		if resp, err := testRequest(b, s, logical.UpdateOperation, "notify/"+name, data); err != nil || resp.IsError() {
+			t.Fatalf("failed to create channel %s: %v %v", name, resp, err)
+		}
+	}
+	if resp, err := testRequest(b, s, logical.ReadOperation, "notify/oncall", nil); err != nil || resp.Data["throttle"] != int64(15*60) {
+		t.Errorf("unexpected channel %v %v", resp, err)
+	}
+
+	activation := func(request string, from string) []notifyResult {
+		t.Helper()
+		results, err := b.notify(ctx, s, &notification{Event: eventActivation, KeyName: "somebody", RequestID: request, RemoteAddr: from})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+	if results := activation("r1", "192.0.2.1"); len(results) != 2 || !results[0].Sent || !results[1].Sent {
+		t.Errorf("first notification of an activation held back: %+v", results)
+	}
+	for _, from := range []string{"192.0.2.2", "192.0.2.3"} {
+		results := activation("r1", from)
+		for _, r := range results {
+			if r.Throttled != (r.Channel == "oncall") {
+				t.Errorf("unexpected result %+v", r)
+			}
+		}
+	}
+	if sent := testNotifier.take(t.Name() + "-oncall"); len(sent) != 1 || sent[0].FurtherAttempts != 0 {
+		t.Errorf("unexpected notifications %+v", sent)
+	}
+	if sent := testNotifier.take(t.Name() + "-all"); len(sent) != 3 {
+		t.Errorf("expected unthrottled channel to get every notification, got %+v", sent)
+	}
+
+	// a security event is not held back by an activation
+	if _, err := b.notify(ctx, s, &notification{Event: eventSecurity, KeyName: "somebody",
+		Security: &securityEvent{Type: securityEventReplayedOTP, Severity: severityCritical}}); err != nil {
+		t.Fatal(err)
+	}
+	if sent := testNotifier.take(t.Name() + "-oncall"); len(sent) != 1 || sent[0].Event != eventSecurity {
+		t.Errorf("unexpected notifications %+v", sent)
+	}
+
+	now := time.Now()
+	if err := b.flushThrottles(ctx, s, now); err != nil {
+		t.Fatal(err)
+	}
+	if sent := testNotifier.take(t.Name() + "-oncall"); len(sent) != 0 {
+		t.Errorf("follow-up sent within the window: %+v", sent)
+	}
+	if err := b.flushThrottles(ctx, s, now.Add(16*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	sent := testNotifier.take(t.Name() + "-oncall")
+	if len(sent) != 1 || sent[0].FurtherAttempts != 2 || sent[0].RemoteAddr != "192.0.2.3" ||
+		sent[0].title() != "Emergency OTP Key 'somebody' was used on Vault (2 further attempts)" {
+		t.Errorf("unexpected follow-up %+v", sent)
+	}
+	if err := b.flushThrottles(ctx, s, now.Add(32*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if paths, err := listRecursive(ctx, s, "throttle/"); err != nil || len(paths) != 0 {
+		t.Errorf("expected quiet throttles to be forgotten, got %v %v", paths, err)
+	}
+
+	// held back attempts of an earlier activation get their own follow-up before a new one
+	activation("r1", "192.0.2.4")
+	activation("r1", "192.0.2.5")
+	testNotifier.take(t.Name() + "-oncall")
+	for _, r := range activation("r2", "192.0.2.6") {
+		if !r.Sent {
+			t.Errorf("first notification of an activation held back: %+v", r)
+		}
+	}
+	sent = testNotifier.take(t.Name() + "-oncall")
+	if len(sent) != 2 || sent[0].RequestID != "r1" || sent[0].FurtherAttempts != 1 || sent[1].RequestID != "r2" || sent[1].FurtherAttempts != 0 {
+		t.Errorf("unexpected notifications %+v", sent)
+	}
+
+	// past the window the next attempt carries the count itself
+	conf, err := b.config(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := getNotifyChannel(ctx, s, "oncall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := b.throttle(ctx, s, conf, c, &notification{Event: eventActivation, KeyName: "somebody", RequestID: "r2"}, now)
+	if err != nil || !held {
+		t.Fatalf("expected notification to be held back: %v", err)
+	}
+	n := &notification{Event: eventActivation, KeyName: "somebody", RequestID: "r2"}
+	held, err = b.throttle(ctx, s, conf, c, n, now.Add(16*time.Minute))
+	if err != nil || held || n.FurtherAttempts != 1 {
+		t.Errorf("unexpected throttle %v %+v %v", held, n, err)
+	}
+}
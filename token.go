@@ -0,0 +1,107 @@
+package main
+
+import (
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/tokenutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// used when neither the mount nor the key set a TTL, these were the fixed values before token parameters were configurable
+const (
+	defaultTokenTTL    = 1 * time.Hour
+	defaultTokenMaxTTL = 24 * time.Hour
+)
+
+// tokenParamFields are the token parameters a key can set, in the order of tokenutil.TokenFields.
+var tokenParamFields = []string{
+	"token_bound_cidrs",
+	"token_explicit_max_ttl",
+	"token_max_ttl",
+	"token_no_default_policy",
+	"token_period",
+	"token_policies",
+	"token_type",
+	"token_ttl",
+	"token_num_uses",
+}
+
+// tokenOverrides lists the token parameters set on the key. Keys written before it was tracked
+// override with every value that is not zero.
+func (k *keyState) tokenOverrides() []string {
+	if k.TokenOverrides != nil {
+		return k.TokenOverrides
+	}
+	p := &k.TokenParams
+	nonZero := map[string]bool{
+		"token_bound_cidrs":       len(p.TokenBoundCIDRs) > 0,
+		"token_explicit_max_ttl":  p.TokenExplicitMaxTTL > 0,
+		"token_max_ttl":           p.TokenMaxTTL > 0,
+		"token_no_default_policy": p.TokenNoDefaultPolicy,
+		"token_period":            p.TokenPeriod > 0,
+		"token_policies":          len(p.TokenPolicies) > 0,
+		"token_type":              p.TokenType != logical.TokenTypeDefault,
+		"token_ttl":               p.TokenTTL > 0,
+		"token_num_uses":          p.TokenNumUses > 0,
+	}
+	overrides := []string{}
+	for _, field := range tokenParamFields {
+		if nonZero[field] {
+			overrides = append(overrides, field)
+		}
+	}
+	return overrides
+}
+
+// effectiveTokenParams merges the token parameters of a key over the ones of the mount,
+// every value set on the key wins, even 0 or false.
+func effectiveTokenParams(mount *tokenutil.TokenParams, key *keyState) *tokenutil.TokenParams {
+	params := *mount
+	for _, field := range key.tokenOverrides() {
+		switch field {
+		case "token_bound_cidrs":
+			params.TokenBoundCIDRs = key.TokenBoundCIDRs
+		case "token_explicit_max_ttl":
+			params.TokenExplicitMaxTTL = key.TokenExplicitMaxTTL
+		case "token_max_ttl":
+			params.TokenMaxTTL = key.TokenMaxTTL
+		case "token_no_default_policy":
+			params.TokenNoDefaultPolicy = key.TokenNoDefaultPolicy
+		case "token_period":
+			params.TokenPeriod = key.TokenPeriod
+		case "token_policies":
+			params.TokenPolicies = key.TokenPolicies
+		case "token_type":
+			params.TokenType = key.TokenType
+		case "token_ttl":
+			params.TokenTTL = key.TokenTTL
+		case "token_num_uses":
+			params.TokenNumUses = key.TokenNumUses
+		}
+	}
+
+	if params.TokenPeriod == 0 {
+		if params.TokenTTL == 0 {
+			params.TokenTTL = defaultTokenTTL
+		}
+		if params.TokenMaxTTL == 0 {
+			params.TokenMaxTTL = defaultTokenMaxTTL
+		}
+	}
+	return &params
+}
+
+// firstTokenTTL is how long a token issued with auth is valid unless it is renewed, at most.
+func (b *backend) firstTokenTTL(auth *logical.Auth) time.Duration {
+	ttl := auth.TTL
+	if auth.Period > 0 {
+		ttl = auth.Period
+	}
+	if ttl == 0 {
+		ttl = b.System().DefaultLeaseTTL()
+	}
+	if auth.ExplicitMaxTTL > 0 && auth.ExplicitMaxTTL < ttl {
+		ttl = auth.ExplicitMaxTTL
+	}
+	return ttl
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const defaultVerifyTimeout = 10 * time.Second
+
+// status codes as defined by the YK-VAL validation protocol
+const (
+	otpStatusOK                  = "OK"
+	otpStatusBadOTP              = "BAD_OTP"
+	otpStatusReplayedOTP         = "REPLAYED_OTP"
+	otpStatusBadSignature        = "BAD_SIGNATURE"
+	otpStatusMissingParameter    = "MISSING_PARAMETER"
+	otpStatusNoSuchClient        = "NO_SUCH_CLIENT"
+	otpStatusOperationNotAllowed = "OPERATION_NOT_ALLOWED"
+	otpStatusBackendError        = "BACKEND_ERROR"
+	otpStatusNotEnoughAnswers    = "NOT_ENOUGH_ANSWERS"
+	otpStatusReplayedRequest     = "REPLAYED_REQUEST"
+)
+
+// otpResult is the outcome of an OTP validation.
+type otpResult struct {
+	OTP            string
+	PublicID       string
+	SessionCounter int64
+	SessionUse     int64
+	// internal timestamp of the key, 8Hz ticks since power up
+	Timestamp int64
+	Status    string
+	// whether the counters above were reported by the verifier
+	CountersKnown bool
+	// validation server that gave the answer, empty for offline validation
+	Server string
+}
+
+func (r *otpResult) OK() bool {
+	return r.Status == otpStatusOK
+}
+
+// otpVerifier validates an OTP.
+// A non-nil error means the validation could not be carried out,
+// a rejected OTP is reported through the status of the result.
+type otpVerifier interface {
+	Verify(ctx context.Context, otp string) (*otpResult, error)
+}
+
+// localVerifier validates OTPs with the AES secret stored on the key, without any outbound call.
+type localVerifier struct {
+	key *keyState
+}
+
+func (v *localVerifier) Verify(ctx context.Context, otp string) (*otpResult, error) {
+	res := &otpResult{OTP: otp}
+	if publicID, _, err := splitOTP(otp); err == nil {
+		res.PublicID = publicID
+	}
+
+	token, err := v.key.verifyOTPLocally(otp)
+	switch {
+	case errors.Is(err, errOTPStoredSecret):
+		return nil, err
+	case err != nil:
+		res.Status = otpStatusBadOTP
+		return res, nil
+	}
+
+	res.Status = otpStatusOK
+	res.SessionCounter = int64(token.Counter)
+	res.SessionUse = int64(token.SessionUse)
+	res.Timestamp = int64(token.Timestamp)
+	res.CountersKnown = true
+	return res, nil
+}
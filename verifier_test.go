@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryVerifier is an in-memory otpVerifier driven by the tests.
+type memoryVerifier struct {
+	lock    sync.Mutex
+	results map[string]*otpResult
+	delay   time.Duration
+	calls   int
+}
+
+func newMemoryVerifier() *memoryVerifier {
+	return &memoryVerifier{results: make(map[string]*otpResult)}
+}
+
+// add registers the result returned for an OTP, unknown OTPs are reported as BAD_OTP.
+func (v *memoryVerifier) add(otp string, status string, counter int64, use int64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.results[otp] = &otpResult{
+		OTP:            otp,
+		PublicID:       otp[:len(otp)-32],
+		SessionCounter: counter,
+		SessionUse:     use,
+		CountersKnown:  true,
+		Status:         status,
+	}
+}
+
+func (v *memoryVerifier) Verify(ctx context.Context, otp string) (*otpResult, error) {
+	v.lock.Lock()
+	v.calls++
+	res, ok := v.results[otp]
+	delay := v.delay
+	v.lock.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	if !ok {
+		return &otpResult{OTP: otp, Status: otpStatusBadOTP}, nil
+	}
+	resCopy := *res
+	return &resCopy, nil
+}
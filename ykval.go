@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ykvalStrategyFailover = "failover"
+	ykvalStrategyParallel = "parallel"
+)
+
+// yubiCloudServers are the public YubiCloud validation servers.
+var yubiCloudServers = []string{"https://api.yubico.com/wsapi/2.0/verify"}
+
+// ykvalVerifier validates OTPs against a list of YK-VAL (yubikey-val) servers
+// speaking the validation protocol version 2.0.
+type ykvalVerifier struct {
+	clientID      string
+	clientKey     []byte
+	servers       []string
+	strategy      string
+	timeout       time.Duration
+	serverTimeout time.Duration
+	client        *http.Client
+}
+
+type ykvalOptions struct {
+	ClientID      string
+	ClientKey     string
+	Servers       []string
+	CABundle      string
+	Proxy         string
+	Strategy      string
+	Timeout       time.Duration
+	ServerTimeout time.Duration
+}
+
+func newYKValVerifier(opts ykvalOptions) (*ykvalVerifier, error) {
+	v := &ykvalVerifier{
+		clientID:      opts.ClientID,
+		servers:       opts.Servers,
+		strategy:      opts.Strategy,
+		timeout:       opts.Timeout,
+		serverTimeout: opts.ServerTimeout,
+	}
+	if len(v.servers) == 0 {
+		return nil, errors.New("no validation server given")
+	}
+	for _, s := range v.servers {
+		if u, err := url.Parse(s); err != nil {
+			return nil, fmt.Errorf("invalid validation server %s: %w", s, err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid validation server %s: scheme must be http or https", s)
+		}
+	}
+	switch v.strategy {
+	case "":
+		v.strategy = ykvalStrategyFailover
+	case ykvalStrategyFailover, ykvalStrategyParallel:
+	default:
+		return nil, fmt.Errorf("unknown query strategy %s", v.strategy)
+	}
+	if v.timeout <= 0 {
+		v.timeout = defaultVerifyTimeout
+	}
+	if v.serverTimeout <= 0 || v.serverTimeout > v.timeout {
+		v.serverTimeout = v.timeout
+	}
+	if opts.ClientKey != "" {
+		key, err := base64.StdEncoding.DecodeString(opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client key: %w", err)
+		}
+		v.clientKey = key
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.CABundle != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(opts.CABundle)) {
+			return nil, errors.New("no certificate found in CA bundle")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if opts.Proxy != "" {
+		proxy, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	v.client = &http.Client{Transport: transport}
+
+	return v, nil
+}
+
+// newYubiCloudVerifier validates OTPs against YubiCloud.
+// yubigo is not used for this as it neither takes a context nor asks for the key counters.
+func newYubiCloudVerifier(clientID string, clientKey string, timeout time.Duration) (*ykvalVerifier, error) {
+	return newYKValVerifier(ykvalOptions{
+		ClientID:  clientID,
+		ClientKey: clientKey,
+		Servers:   yubiCloudServers,
+		Timeout:   timeout,
+	})
+}
+
+func (v *ykvalVerifier) sign(values []string) string {
+	sort.Strings(values)
+	mac := hmac.New(sha1.New, v.clientKey)
+	mac.Write([]byte(strings.Join(values, "&")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// conclusive tells whether a status is final or another server should be asked.
+func ykvalConclusive(status string) bool {
+	switch status {
+	case otpStatusBackendError, otpStatusNotEnoughAnswers, otpStatusReplayedRequest:
+		return false
+	}
+	return true
+}
+
+func (v *ykvalVerifier) Verify(ctx context.Context, otp string) (*otpResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	nonceRaw := make([]byte, 16)
+	if _, err := rand.Read(nonceRaw); err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(nonceRaw)
+
+	// timestamp=1 asks for the key counters to be included in the response
+	params := []string{"id=" + v.clientID, "nonce=" + nonce, "otp=" + otp, "timestamp=1"}
+	query := url.Values{}
+	query.Set("id", v.clientID)
+	query.Set("otp", otp)
+	query.Set("nonce", nonce)
+	query.Set("timestamp", "1")
+	if len(v.clientKey) > 0 {
+		query.Set("h", v.sign(params))
+	}
+
+	if v.strategy == ykvalStrategyParallel {
+		return v.verifyParallel(ctx, otp, nonce, query)
+	}
+
+	var lastErr error
+	var lastRes *otpResult
+	for _, server := range v.servers {
+		res, err := v.query(ctx, server, otp, nonce, query)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if ykvalConclusive(res.Status) {
+			return res, nil
+		}
+		lastRes = res
+	}
+	if lastRes != nil {
+		return lastRes, nil
+	}
+	return nil, fmt.Errorf("none of the validation servers responded properly: %w", lastErr)
+}
+
+func (v *ykvalVerifier) verifyParallel(ctx context.Context, otp string, nonce string, query url.Values) (*otpResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type queryResult struct {
+		res *otpResult
+		err error
+	}
+	results := make(chan queryResult, len(v.servers))
+	for _, server := range v.servers {
+		go func(server string) {
+			res, err := v.query(ctx, server, otp, nonce, query)
+			results <- queryResult{res, err}
+		}(server)
+	}
+
+	var lastErr error
+	var lastRes *otpResult
+	for range v.servers {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if ykvalConclusive(r.res.Status) {
+			return r.res, nil
+		}
+		lastRes = r.res
+	}
+	if lastRes != nil {
+		return lastRes, nil
+	}
+	return nil, fmt.Errorf("none of the validation servers responded properly: %w", lastErr)
+}
+
+func (v *ykvalVerifier) query(ctx context.Context, server string, otp string, nonce string, query url.Values) (*otpResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, v.serverTimeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, server+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("User-Agent", "vault-auth-emerg-yubiotp")
+	resp, err := v.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("validation server %s returned %s", server, resp.Status)
+	}
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	res := &otpResult{
+		OTP:    otp,
+		Status: values["status"],
+		Server: server,
+	}
+	if res.Status == "" {
+		return nil, fmt.Errorf("validation server %s returned no status", server)
+	}
+
+	// a signed response is required whenever we have a key, even for errors
+	if len(v.clientKey) > 0 {
+		signed := make([]string, 0, len(values))
+		for k, val := range values {
+			if k != "h" {
+				signed = append(signed, k+"="+val)
+			}
+		}
+		if !hmac.Equal([]byte(v.sign(signed)), []byte(values["h"])) {
+			res.Status = otpStatusBadSignature
+			return res, nil
+		}
+	}
+	if !res.OK() {
+		return res, nil
+	}
+	if values["otp"] != otp || values["nonce"] != nonce {
+		return nil, fmt.Errorf("validation server %s returned a response for another request", server)
+	}
+
+	if len(otp) > 32 {
+		res.PublicID = otp[:len(otp)-32]
+	}
+	counter, errCounter := strconv.ParseInt(values["sessioncounter"], 10, 64)
+	use, errUse := strconv.ParseInt(values["sessionuse"], 10, 64)
+	if errCounter == nil && errUse == nil {
+		res.SessionCounter, res.SessionUse = counter, use
+		res.CountersKnown = true
+	}
+	res.Timestamp, _ = strconv.ParseInt(values["timestamp"], 10, 64)
+	return res, nil
+}
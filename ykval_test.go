@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testYKValKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123"))
+
+func testYKValSign(values []string) string {
+	key, _ := base64.StdEncoding.DecodeString(testYKValKey)
+	sort.Strings(values)
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(strings.Join(values, "&")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// testYKValHandler is a stand-in for the YK-VAL verify endpoint.
+func testYKValHandler(t *testing.T, status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var params []string
+		for k := range q {
+			if k != "h" {
+				params = append(params, k+"="+q.Get(k))
+			}
+		}
+		if testYKValSign(params) != q.Get("h") {
+			t.Errorf("bad request signature")
+		}
+
+		values := []string{
+			"otp=" + q.Get("otp"),
+			"nonce=" + q.Get("nonce"),
+			"t=2023-05-08T08:30:19Z0000",
+			"status=" + status,
+			"sessioncounter=7",
+			"sessionuse=2",
+			"timestamp=1234",
+		}
+		for _, v := range values {
+			fmt.Fprintf(w, "%s\r\n", v)
+		}
+		fmt.Fprintf(w, "h=%s\r\n", testYKValSign(values))
+	}
+}
+
+func TestYKValFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	busy := httptest.NewServer(testYKValHandler(t, otpStatusBackendError))
+	defer busy.Close()
+	up := httptest.NewServer(testYKValHandler(t, otpStatusOK))
+	defer up.Close()
+
+	v, err := newYKValVerifier(ykvalOptions{
+		ClientID:  "1",
+		ClientKey: testYKValKey,
+		Servers:   []string{down.URL, busy.URL, up.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := v.Verify(context.Background(), testOTP(testPublicID, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() || res.Server != up.URL || res.SessionCounter != 7 || res.SessionUse != 2 || res.PublicID != testPublicID {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+func TestYKValParallel(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	up := httptest.NewServer(testYKValHandler(t, otpStatusOK))
+	defer up.Close()
+
+	v, err := newYKValVerifier(ykvalOptions{
+		ClientID:  "1",
+		ClientKey: testYKValKey,
+		Servers:   []string{slow.URL, up.URL},
+		Strategy:  ykvalStrategyParallel,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	res, err := v.Verify(context.Background(), testOTP(testPublicID, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() || res.Server != up.URL {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Error("parallel query waited for the slow server")
+	}
+}
+
+func TestYKValBadResponseSignature(t *testing.T) {
+	// an answer tampered with on the way, or from someone without the key
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		fmt.Fprintf(w, "otp=%s\r\nnonce=%s\r\nstatus=OK\r\nh=%s\r\n", q.Get("otp"), q.Get("nonce"), testYKValSign(nil))
+	}))
+	defer srv.Close()
+
+	v, err := newYKValVerifier(ykvalOptions{
+		ClientID:  "1",
+		ClientKey: testYKValKey,
+		Servers:   []string{srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := v.Verify(context.Background(), testOTP(testPublicID, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != otpStatusBadSignature {
+		t.Errorf("expected BAD_SIGNATURE, got %s", res.Status)
+	}
+}
+
+func TestYKValCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(testYKValHandler(t, otpStatusOK))
+	defer srv.Close()
+
+	if _, err := newYKValVerifier(ykvalOptions{
+		ClientID: "1",
+		Servers:  []string{srv.URL},
+		CABundle: "not a certificate",
+	}); err == nil {
+		t.Error("invalid CA bundle was accepted")
+	}
+
+	untrusted, err := newYKValVerifier(ykvalOptions{
+		ClientID:  "1",
+		ClientKey: testYKValKey,
+		Servers:   []string{srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := untrusted.Verify(context.Background(), testOTP(testPublicID, 1)); err == nil {
+		t.Error("untrusted server certificate was accepted")
+	}
+
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	v, err := newYKValVerifier(ykvalOptions{
+		ClientID:  "1",
+		ClientKey: testYKValKey,
+		Servers:   []string{srv.URL},
+		CABundle:  string(bundle),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := v.Verify(context.Background(), testOTP(testPublicID, 1)); err != nil {
+		t.Fatal(err)
+	} else if !res.OK() {
+		t.Errorf("unexpected status %s", res.Status)
+	}
+}